@@ -0,0 +1,17 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps uploaded files such as leave request attachments. Keys are
+// chosen by the store and are safe to save in the database.
+type Store interface {
+	Put(ctx context.Context, name string, r io.Reader) (string, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
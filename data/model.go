@@ -2,6 +2,7 @@ package data
 
 import (
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
@@ -12,32 +13,168 @@ type User struct {
 	Email    string        `json:"email"`
 	Password string        `json:"password"`
 	Role     string        `json:"role"`
+	// deactivated users cannot log in
+	Deactivated   bool `json:"deactivated"`
+	EmailVerified bool `json:"emailVerified" bson:"email_verified"`
 }
 
 type Class struct {
-	ID         bson.ObjectID   `json:"_id" bson:"_id"`
-	ClassName  string          `json:"classname"`
-	TeacherID  bson.ObjectID   `json:"teacherId" bson:"teacher_id"`
-	StudentIDs []bson.ObjectID `json:"studentIds" bson:"student_ids"`
+	ID             bson.ObjectID   `json:"_id" bson:"_id"`
+	ClassName      string          `json:"classname"`
+	TeacherID      bson.ObjectID   `json:"teacherId" bson:"teacher_id"`
+	StudentIDs     []bson.ObjectID `json:"studentIds" bson:"student_ids"`
+	CustomStatuses []StatusRule    `json:"customStatuses" bson:"custom_statuses"`
+	Location       *ClassLocation  `json:"location,omitempty" bson:"location,omitempty"`
+	CheckInWindow  *CheckInWindow  `json:"checkInWindow,omitempty" bson:"checkin_window,omitempty"`
+	RollCallPolicy *RollCallPolicy `json:"rollCallPolicy,omitempty" bson:"roll_call_policy,omitempty"`
 }
 
-type AttendanceStatus map[string]string
+// what happens to students who miss a roll call
+const (
+	RollCallFlag      = "flag"
+	RollCallDowngrade = "downgrade"
+)
+
+// RollCallPolicy decides what happens to a student who does not answer a
+// roll call in time. Downgraded students get DowngradeTo, absent by default.
+type RollCallPolicy struct {
+	Action      string `json:"action" bson:"action" binding:"required,oneof=flag downgrade"`
+	DowngradeTo string `json:"downgradeTo,omitempty" bson:"downgrade_to,omitempty"`
+}
+
+// CheckInWindow is how long after the start self check-ins count as present,
+// and after how long they are refused. Check-ins in between are late. A zero
+// value means no limit.
+type CheckInWindow struct {
+	OnTimeMinutes int `json:"onTimeMinutes" bson:"on_time_minutes" binding:"gte=0"`
+	CutoffMinutes int `json:"cutoffMinutes" bson:"cutoff_minutes" binding:"gte=0"`
+}
+
+// ClassLocation is the optional geofence self check-ins must fall inside.
+type ClassLocation struct {
+	Latitude     float64 `json:"latitude" bson:"latitude" binding:"gte=-90,lte=90"`
+	Longitude    float64 `json:"longitude" bson:"longitude" binding:"gte=-180,lte=180"`
+	RadiusMeters float64 `json:"radiusMeters" bson:"radius_meters" binding:"gt=0"`
+}
+
+type Coordinates struct {
+	Latitude  float64 `json:"latitude" bson:"latitude" binding:"gte=-90,lte=90"`
+	Longitude float64 `json:"longitude" bson:"longitude" binding:"gte=-180,lte=180"`
+}
+
+// Mark is the attendance of one student in a session and how it was taken.
+type Mark struct {
+	Status         string       `json:"status" bson:"status"`
+	MarkedAt       time.Time    `json:"markedAt" bson:"marked_at"`
+	Method         string       `json:"method,omitempty" bson:"method,omitempty"`
+	Location       *Coordinates `json:"location,omitempty" bson:"location,omitempty"`
+	DistanceMeters *float64     `json:"distanceMeters,omitempty" bson:"distance_meters,omitempty"`
+	Device         *Device      `json:"device,omitempty" bson:"device,omitempty"`
+}
+
+// Device identifies where a self check-in came from.
+type Device struct {
+	IP        string `json:"ip" bson:"ip"`
+	UserAgent string `json:"userAgent" bson:"user_agent"`
+	DeviceID  string `json:"deviceId,omitempty" bson:"device_id,omitempty"`
+}
+
+// CheckInFlag records a check-in that shares its device with check-ins of
+// other students in the same session.
+type CheckInFlag struct {
+	ID              bson.ObjectID `json:"_id" bson:"_id"`
+	SessionID       bson.ObjectID `json:"sessionId" bson:"session_id"`
+	ClassID         bson.ObjectID `json:"classId" bson:"class_id"`
+	StudentID       string        `json:"studentId" bson:"student_id"`
+	OtherStudentIDs []string      `json:"otherStudentIds" bson:"other_student_ids"`
+	Reasons         []string      `json:"reasons" bson:"reasons"`
+	Device          Device        `json:"device" bson:"device"`
+	CreatedAt       time.Time     `json:"createdAt" bson:"created_at"`
+}
+
+// UnmarshalBSONValue also accepts the bare status strings stored before marks
+// carried details.
+func (m *Mark) UnmarshalBSONValue(typ byte, raw []byte) error {
+	value := bson.RawValue{Type: bson.Type(typ), Value: raw}
+	if status, ok := value.StringValueOK(); ok {
+		*m = Mark{Status: status}
+		return nil
+	}
+
+	type plainMark Mark
+	mark := plainMark{}
+	if err := value.Unmarshal(&mark); err != nil {
+		return err
+	}
+	*m = Mark(mark)
+	return nil
+}
+
+type AttendanceStatus map[string]Mark
 
 //validate Role -> teacher | student
-//validate Status -> present | absent
+//validate Status -> see status.go
 
 type Session struct {
-	sync.Mutex
-	ClassID          bson.ObjectID
-	StartedAt        string
-	AttendanceStatus AttendanceStatus
+	sync.Mutex       `bson:"-"`
+	ID               bson.ObjectID    `bson:"_id"`
+	ClassID          bson.ObjectID    `bson:"class_id"`
+	TeacherID        bson.ObjectID    `bson:"teacher_id"`
+	StudentIDs       []bson.ObjectID  `bson:"student_ids"`
+	CustomStatuses   []StatusRule     `bson:"custom_statuses"`
+	Location         *ClassLocation   `bson:"location,omitempty"`
+	RollCallPolicy   *RollCallPolicy  `bson:"roll_call_policy,omitempty"`
+	StartedAt        string           `bson:"started_at"`
+	EndedAt          string           `bson:"ended_at,omitempty"`
+	Summary          SessionSummary   `bson:"summary"`
+	ExpiresAt        time.Time        `bson:"expires_at"`
+	OnTimeUntil      time.Time        `bson:"on_time_until"`
+	CutoffAt         time.Time        `bson:"cutoff_at"`
+	LastActivityAt   time.Time        `bson:"last_activity_at"`
+	Settings         SessionSettings  `bson:"settings"`
+	Paused           bool             `bson:"paused"`
+	CheckInSecret    []byte           `bson:"checkin_secret"`
+	State            string           `bson:"state"`
+	AttendanceStatus AttendanceStatus `bson:"attendance_status"`
+	// wrong check-in codes per student, kept in memory only
+	FailedCheckIns map[string]int `bson:"-"`
+}
+
+type SessionSummary struct {
+	Present  int            `json:"present" bson:"present"`
+	Absent   int            `json:"absent" bson:"absent"`
+	Total    int            `json:"total" bson:"total"`
+	ByStatus map[string]int `json:"byStatus" bson:"by_status"`
 }
 
+// SessionSettings are the per-session limits chosen when attendance starts.
+type SessionSettings struct {
+	MaxDuration  time.Duration `bson:"max_duration"`
+	IdleTimeout  time.Duration `bson:"idle_timeout"`
+	OnTimeWindow time.Duration `bson:"on_time_window"`
+	Cutoff       time.Duration `bson:"cutoff"`
+	// share of the session a student must be connected for to be marked
+	// present automatically, zero when off
+	AutoPresentShare float64 `bson:"auto_present_share"`
+}
+
+const (
+	SessionOpen = "open"
+	// SessionClosing is a session whose records are being written
+	SessionClosing   = "closing"
+	SessionFinished  = "finished"
+	SessionCancelled = "cancelled"
+)
+
 type Attendance struct {
 	ID        bson.ObjectID `json:"_id" bson:"_id"`
+	SessionID bson.ObjectID `json:"sessionId"`
 	ClassID   bson.ObjectID `json:"classId"`
 	StudentID bson.ObjectID `json:"studentId"`
 	Status    string        `json:"status"`
+	MarkedAt  time.Time     `json:"markedAt"`
+	Method    string        `json:"method,omitempty" bson:",omitempty"`
+	Location  *Coordinates  `json:"location,omitempty" bson:",omitempty"`
 }
 
 type Student struct {
@@ -51,3 +188,118 @@ type StudentResponse struct {
 	Name  string `json:"name"`
 	Email string `json:"email" `
 }
+
+// UserResponse is a user as admins see it, without the password hash.
+type UserResponse struct {
+	ID            string `json:"_id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	Deactivated   bool   `json:"deactivated"`
+	EmailVerified bool   `json:"emailVerified"`
+}
+
+const (
+	LeavePending  = "pending"
+	LeaveApproved = "approved"
+	LeaveRejected = "rejected"
+)
+
+// LeaveRequest is a student asking to be excused for one session or for every
+// session in a date range.
+type LeaveRequest struct {
+	ID         bson.ObjectID  `json:"_id" bson:"_id"`
+	ClassID    bson.ObjectID  `json:"classId" bson:"class_id"`
+	StudentID  bson.ObjectID  `json:"studentId" bson:"student_id"`
+	SessionID  *bson.ObjectID `json:"sessionId,omitempty" bson:"session_id,omitempty"`
+	From       *time.Time     `json:"from,omitempty" bson:"from,omitempty"`
+	To         *time.Time     `json:"to,omitempty" bson:"to,omitempty"`
+	Reason     string         `json:"reason" bson:"reason"`
+	Attachment *Attachment    `json:"attachment,omitempty" bson:"attachment,omitempty"`
+	Status     string         `json:"status" bson:"status"`
+	ReviewedBy *bson.ObjectID `json:"reviewedBy,omitempty" bson:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time     `json:"reviewedAt,omitempty" bson:"reviewed_at,omitempty"`
+	ReviewNote string         `json:"reviewNote,omitempty" bson:"review_note,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt" bson:"created_at"`
+}
+
+type Attachment struct {
+	Key         string `json:"-" bson:"key"`
+	FileName    string `json:"fileName" bson:"file_name"`
+	ContentType string `json:"contentType" bson:"content_type"`
+	Size        int64  `json:"size" bson:"size"`
+}
+
+// RecordChange is one entry in the append-only history of a persisted
+// attendance record.
+type RecordChange struct {
+	ID        bson.ObjectID `json:"_id" bson:"_id"`
+	RecordID  bson.ObjectID `json:"recordId" bson:"record_id"`
+	SessionID bson.ObjectID `json:"sessionId" bson:"session_id"`
+	ClassID   bson.ObjectID `json:"classId" bson:"class_id"`
+	StudentID bson.ObjectID `json:"studentId" bson:"student_id"`
+	OldStatus string        `json:"oldStatus" bson:"old_status"`
+	NewStatus string        `json:"newStatus" bson:"new_status"`
+	Reason    string        `json:"reason" bson:"reason"`
+	ChangedBy bson.ObjectID `json:"changedBy" bson:"changed_by"`
+	ChangedAt time.Time     `json:"changedAt" bson:"changed_at"`
+}
+
+// RefreshToken is a stored refresh token; only its hash is kept. Tokens that
+// replaced one another share a family, so reusing a rotated token revokes the
+// whole login.
+type RefreshToken struct {
+	ID        bson.ObjectID `bson:"_id"`
+	UserID    bson.ObjectID `bson:"user_id"`
+	Hash      string        `bson:"hash"`
+	Family    string        `bson:"family"`
+	ExpiresAt time.Time     `bson:"expires_at"`
+	CreatedAt time.Time     `bson:"created_at"`
+	RevokedAt *time.Time    `bson:"revoked_at,omitempty"`
+}
+
+// RevokedToken blocks an access token by its jti, or every access token of a
+// login by its family, until they would have expired anyway.
+type RevokedToken struct {
+	ID        string    `bson:"_id"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// what an email token proves
+const (
+	VerifyEmail   = "verify_email"
+	ResetPassword = "reset_password"
+)
+
+// EmailToken is a single-use token mailed to a user. Only its hash is kept.
+// Email is the address it was sent to, so a token stops working if the
+// address changes.
+type EmailToken struct {
+	ID        bson.ObjectID `bson:"_id"`
+	UserID    bson.ObjectID `bson:"user_id"`
+	Purpose   string        `bson:"purpose"`
+	Hash      string        `bson:"hash"`
+	Email     string        `bson:"email"`
+	ExpiresAt time.Time     `bson:"expires_at"`
+	CreatedAt time.Time     `bson:"created_at"`
+	UsedAt    *time.Time    `bson:"used_at,omitempty"`
+}
+
+// login lockout events
+const (
+	LockoutStarted = "lockout"
+	LockoutCleared = "unlock"
+)
+
+// LockoutEvent records a login lockout starting or being cleared. Scope is
+// "ip" or "account", and Key the address or email that was locked.
+type LockoutEvent struct {
+	ID        bson.ObjectID  `json:"_id" bson:"_id"`
+	Event     string         `json:"event" bson:"event"`
+	Scope     string         `json:"scope" bson:"scope"`
+	Key       string         `json:"key" bson:"key"`
+	Until     *time.Time     `json:"until,omitempty" bson:"until,omitempty"`
+	Reason    string         `json:"reason,omitempty" bson:"reason,omitempty"`
+	ChangedBy *bson.ObjectID `json:"changedBy,omitempty" bson:"changed_by,omitempty"`
+	CreatedAt time.Time      `json:"createdAt" bson:"created_at"`
+}
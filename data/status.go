@@ -0,0 +1,74 @@
+package data
+
+const (
+	StatusPresent = "present"
+	StatusAbsent  = "absent"
+	StatusLate    = "late"
+	StatusExcused = "excused"
+	StatusRemote  = "remote"
+)
+
+// what a status counts towards in the present/absent totals
+const (
+	CountsAsPresent = "present"
+	CountsAsAbsent  = "absent"
+	CountsAsNone    = "none"
+)
+
+// StatusRule names a status a student can be marked with and how it is
+// counted in summaries.
+type StatusRule struct {
+	Name     string `json:"name" bson:"name" binding:"required"`
+	CountsAs string `json:"countsAs" bson:"counts_as" binding:"required,oneof=present absent none"`
+}
+
+var BuiltinStatuses = []StatusRule{
+	{Name: StatusPresent, CountsAs: CountsAsPresent},
+	{Name: StatusAbsent, CountsAs: CountsAsAbsent},
+	{Name: StatusLate, CountsAs: CountsAsPresent},
+	{Name: StatusExcused, CountsAs: CountsAsNone},
+	{Name: StatusRemote, CountsAs: CountsAsPresent},
+}
+
+// FindStatusRule looks the status up among the built-in statuses and the
+// custom statuses of a class.
+func FindStatusRule(custom []StatusRule, name string) (StatusRule, bool) {
+	for _, v := range BuiltinStatuses {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	for _, v := range custom {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return StatusRule{}, false
+}
+
+func IsBuiltinStatus(name string) bool {
+	_, ok := FindStatusRule(nil, name)
+	return ok
+}
+
+// Summarize counts the marks by status and by what they count towards.
+func Summarize(status AttendanceStatus, custom []StatusRule) SessionSummary {
+	summary := SessionSummary{
+		ByStatus: map[string]int{},
+	}
+	for _, v := range status {
+		rule, ok := FindStatusRule(custom, v.Status)
+		if !ok {
+			continue
+		}
+		summary.ByStatus[v.Status]++
+		summary.Total++
+		switch rule.CountsAs {
+		case CountsAsPresent:
+			summary.Present++
+		case CountsAsAbsent:
+			summary.Absent++
+		}
+	}
+	return summary
+}
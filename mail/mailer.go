@@ -0,0 +1,17 @@
+package mail
+
+import (
+	"context"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers plain text mail such as verification and password reset
+// links.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
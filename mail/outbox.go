@@ -0,0 +1,61 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxOutboxMessages is how many messages an in-memory outbox keeps; older ones
+// are dropped.
+const maxOutboxMessages = 100
+
+// Outbox keeps sent mail instead of delivering it, for development and
+// tests. With a directory, each message is written there as a file instead
+// of being kept in memory.
+type Outbox struct {
+	sync.Mutex
+	dir      string
+	sent     int
+	messages []Message
+}
+
+// NewOutbox makes an outbox. An empty dir keeps the latest messages in memory.
+func NewOutbox(dir string) (*Outbox, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.sent++
+	if o.dir == "" {
+		if len(o.messages) == maxOutboxMessages {
+			o.messages = append(o.messages[:0], o.messages[1:]...)
+		}
+		o.messages = append(o.messages, msg)
+		return nil
+	}
+
+	name := fmt.Sprintf("%d-%03d.txt", time.Now().UnixNano(), o.sent)
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(o.dir, name), []byte(content), 0o644)
+}
+
+// Messages returns a copy of the messages kept in memory, oldest first. It is
+// empty when the outbox writes to a directory.
+func (o *Outbox) Messages() []Message {
+	o.Lock()
+	defer o.Unlock()
+
+	return append([]Message(nil), o.messages...)
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Policy says how many attempts a key gets and how long it is locked out
+// after running through them.
+type Policy struct {
+	// Attempts is how many hits a key gets per Window. The hit that uses
+	// up the last one locks the key.
+	Attempts int
+	Window   time.Duration
+	// Lockout is how long the first lockout lasts. Each lockout after it
+	// doubles, up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// lockout is how long the strikes-th lockout in a row lasts.
+func (p Policy) lockout(strikes int) time.Duration {
+	d := p.Lockout
+	for i := 1; i < strikes && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
+
+// Limiter counts attempts per key, such as an IP address or an account, and
+// locks keys out that make too many. Implementations backed by a shared store
+// let several instances enforce the same limits.
+type Limiter interface {
+	// Check returns how long the key is still locked out, zero if it is not.
+	Check(ctx context.Context, key string) (time.Duration, error)
+	// Hit counts an attempt. When it locks the key, Hit returns how long
+	// the lockout lasts.
+	Hit(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the key's attempts and lockouts. It reports whether that
+	// ended a lockout Expired has not returned, so every lockout ends once.
+	Reset(ctx context.Context, key string) (bool, error)
+	// Expired returns the keys whose lockout ran out since the last call.
+	Expired(ctx context.Context) ([]string, error)
+}
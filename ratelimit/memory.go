@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	windowStart time.Time
+	hits        int
+	lockedUntil time.Time
+	// strikes counts lockouts in a row, which makes each one longer
+	strikes int
+	// expired is set once Expired returned the key for its last lockout
+	expired bool
+}
+
+// forgotten reports whether the entry holds nothing still needed: its window
+// is over, it was not locked out within MaxLockout and the end of its last
+// lockout was reported.
+func (e *entry) forgotten(p Policy, now time.Time) bool {
+	return now.Sub(e.windowStart) >= p.Window && now.Sub(e.lockedUntil) >= p.MaxLockout && (e.strikes == 0 || e.expired)
+}
+
+// Memory is a Limiter for a single instance, keeping its counts in memory.
+type Memory struct {
+	sync.Mutex
+	policy    Policy
+	entries   map[string]*entry
+	lastSweep time.Time
+	// keys whose lockout ended unreported before they were locked again
+	ended []string
+	now   func() time.Time
+}
+
+func NewMemory(policy Policy) *Memory {
+	return &Memory{
+		policy:  policy,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Check(ctx context.Context, key string) (time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	if wait := e.lockedUntil.Sub(m.now()); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (m *Memory) Hit(ctx context.Context, key string) (time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	e, ok := m.entries[key]
+	if !ok || e.forgotten(m.policy, now) {
+		e = &entry{windowStart: now}
+		m.entries[key] = e
+	}
+	if now.Sub(e.windowStart) >= m.policy.Window {
+		e.windowStart = now
+		e.hits = 0
+	}
+
+	e.hits++
+	if e.hits < m.policy.Attempts {
+		return 0, nil
+	}
+
+	if e.strikes > 0 && !e.expired {
+		m.ended = append(m.ended, key)
+	}
+	e.strikes++
+	lockout := m.policy.lockout(e.strikes)
+	e.lockedUntil = now.Add(lockout)
+	e.expired = false
+	// the lockout starts a fresh window
+	e.windowStart = e.lockedUntil
+	e.hits = 0
+	return lockout, nil
+}
+
+func (m *Memory) Reset(ctx context.Context, key string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return false, nil
+	}
+	delete(m.entries, key)
+	return e.strikes > 0 && !e.expired, nil
+}
+
+func (m *Memory) Expired(ctx context.Context) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	keys := m.ended
+	m.ended = nil
+	for key, e := range m.entries {
+		if e.strikes > 0 && !e.expired && !now.Before(e.lockedUntil) {
+			e.expired = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// sweep drops forgotten entries, at most once a minute, so keys that stop
+// trying do not pile up.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+
+	for key, e := range m.entries {
+		if e.forgotten(m.policy, now) {
+			delete(m.entries, key)
+		}
+	}
+}
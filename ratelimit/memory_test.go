@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	Attempts:   3,
+	Window:     time.Minute,
+	Lockout:    time.Minute,
+	MaxLockout: 4 * time.Minute,
+}
+
+// testMemory is a Memory on a clock the test moves by hand.
+func testMemory(t *testing.T) (*Memory, func(time.Duration)) {
+	t.Helper()
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	m := NewMemory(testPolicy)
+	m.now = func() time.Time { return now }
+	return m, func(d time.Duration) { now = now.Add(d) }
+}
+
+// lockKey hits the key until it is locked and returns the lockout.
+func lockKey(t *testing.T, m *Memory, key string) time.Duration {
+	t.Helper()
+	for i := 1; i <= testPolicy.Attempts; i++ {
+		lockout, err := m.Hit(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < testPolicy.Attempts && lockout != 0 {
+			t.Fatalf("hit %d locked the key for %v", i, lockout)
+		}
+		if i == testPolicy.Attempts {
+			return lockout
+		}
+	}
+	return 0
+}
+
+func TestPolicyLockout(t *testing.T) {
+	tests := []struct {
+		strikes int
+		want    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 4 * time.Minute},
+		{50, 4 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.lockout(tt.strikes); got != tt.want {
+			t.Errorf("lockout(%d) = %v, want %v", tt.strikes, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryEscalation(t *testing.T) {
+	tests := []struct {
+		name string
+		// quiet is how long the key waits after its last lockout ran out
+		quiet time.Duration
+		want  []time.Duration
+	}{
+		{"lockouts in a row double up to the max", 0, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute}},
+		{"quiet shorter than the max lockout keeps counting", 3 * time.Minute, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}},
+		{"quiet longer than the max lockout starts over", 5 * time.Minute, []time.Duration{time.Minute, time.Minute, time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, advance := testMemory(t)
+			for i, want := range tt.want {
+				lockout := lockKey(t, m, "key")
+				if lockout != want {
+					t.Fatalf("lockout %d = %v, want %v", i+1, lockout, want)
+				}
+
+				wait, _ := m.Check(context.Background(), "key")
+				if wait != lockout {
+					t.Fatalf("Check() = %v while locked, want %v", wait, lockout)
+				}
+				advance(lockout)
+				if wait, _ := m.Check(context.Background(), "key"); wait != 0 {
+					t.Fatalf("Check() = %v after the lockout, want 0", wait)
+				}
+				m.Expired(context.Background())
+				advance(tt.quiet)
+			}
+		})
+	}
+}
+
+func TestMemoryWindow(t *testing.T) {
+	m, advance := testMemory(t)
+
+	for i := 0; i < testPolicy.Attempts-1; i++ {
+		if lockout, _ := m.Hit(context.Background(), "key"); lockout != 0 {
+			t.Fatalf("hit %d locked the key", i+1)
+		}
+	}
+	advance(testPolicy.Window)
+	// the window ran out, so the count starts over
+	if lockout, _ := m.Hit(context.Background(), "key"); lockout != 0 {
+		t.Fatal("hit in a new window locked the key")
+	}
+}
+
+func TestMemoryResetAndExpired(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool)
+		// expired are the keys Expired returns after the steps, reset
+		// what the final Reset reports
+		expired []string
+		reset   bool
+	}{
+		{"unknown key", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			ended, _ := m.Reset(ctx, "key")
+			keys, _ := m.Expired(ctx)
+			return keys, ended
+		}, nil, false},
+		{"reset while locked ends the lockout", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			lockKey(t, m, "key")
+			ended, _ := m.Reset(ctx, "key")
+			advance(time.Hour)
+			keys, _ := m.Expired(ctx)
+			return keys, ended
+		}, nil, true},
+		{"reset without a lockout", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			m.Hit(ctx, "key")
+			ended, _ := m.Reset(ctx, "key")
+			keys, _ := m.Expired(ctx)
+			return keys, ended
+		}, nil, false},
+		{"lockout still running", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			lockKey(t, m, "key")
+			advance(time.Second)
+			keys, _ := m.Expired(ctx)
+			return keys, false
+		}, nil, false},
+		{"lockout ran out", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			lockKey(t, m, "key")
+			advance(time.Minute)
+			keys, _ := m.Expired(ctx)
+			return keys, false
+		}, []string{"key"}, false},
+		{"ran out lockout is reported once", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			lockKey(t, m, "key")
+			advance(time.Minute)
+			m.Expired(ctx)
+			keys, _ := m.Expired(ctx)
+			ended, _ := m.Reset(ctx, "key")
+			return keys, ended
+		}, nil, false},
+		{"relocked before the end was reported", func(t *testing.T, m *Memory, advance func(time.Duration)) ([]string, bool) {
+			lockKey(t, m, "key")
+			advance(time.Minute)
+			lockKey(t, m, "key")
+			keys, _ := m.Expired(ctx)
+			return keys, false
+		}, []string{"key"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, advance := testMemory(t)
+			expired, reset := tt.run(t, m, advance)
+			if !slices.Equal(expired, tt.expired) {
+				t.Errorf("Expired() = %v, want %v", expired, tt.expired)
+			}
+			if reset != tt.reset {
+				t.Errorf("Reset() = %v, want %v", reset, tt.reset)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// AdminEmailEnv names a user promoted to admin at startup, so the first admin
+// does not have to be made by hand in the database.
+const AdminEmailEnv = "ADMIN_EMAIL"
+
+const defaultUsersPageSize = 20
+
+func usersCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("users")
+}
+
+// EnsureAdmin promotes the user named in ADMIN_EMAIL to admin.
+func EnsureAdmin(db *mongo.Client) error {
+	email := os.Getenv(AdminEmailEnv)
+	if email == "" {
+		return nil
+	}
+
+	res, err := usersCollection(db).UpdateOne(context.Background(), bson.M{"email": email}, bson.M{"$set": bson.M{"role": "admin"}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	return nil
+}
+
+func AdminRoleAuth() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		if c.GetString("role") == "admin" {
+			c.Next()
+		} else {
+			c.JSON(403, gin.H{
+				"success": false,
+				"error":   "Forbidden, admin access required",
+			})
+			c.Abort()
+			return
+		}
+	}
+
+}
+
+func userResponse(user data.User) data.UserResponse {
+	return data.UserResponse{
+		ID:            user.ID.Hex(),
+		Name:          user.Name,
+		Email:         user.Email,
+		Role:          user.Role,
+		Deactivated:   user.Deactivated,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+type ListUsersQuery struct {
+	Search      string `form:"q"`
+	Role        string `form:"role" binding:"omitempty,oneof=student teacher admin"`
+	Deactivated *bool  `form:"deactivated"`
+	Page        int    `form:"page" binding:"gte=0"`
+	Limit       int    `form:"limit" binding:"gte=0,lte=100"`
+}
+
+// listUsers lists users page by page, optionally searching names and emails.
+func listUsers(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := ListUsersQuery{}
+		if err := c.ShouldBindQuery(&query); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+		if query.Limit == 0 {
+			query.Limit = defaultUsersPageSize
+		}
+		if query.Page == 0 {
+			query.Page = 1
+		}
+
+		filter := bson.M{}
+		if query.Search != "" {
+			pattern := bson.Regex{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+			filter["$or"] = bson.A{
+				bson.M{"name": pattern},
+				bson.M{"email": pattern},
+			}
+		}
+		if query.Role != "" {
+			filter["role"] = query.Role
+		}
+		if query.Deactivated != nil {
+			if *query.Deactivated {
+				filter["deactivated"] = true
+			} else {
+				filter["deactivated"] = bson.M{"$ne": true}
+			}
+		}
+
+		total, err := usersCollection(db).CountDocuments(c, filter)
+		if err != nil {
+			util.InternalServerError(c, err, "users counting err")
+			return
+		}
+
+		opts := options.Find().
+			SetSort(bson.M{"_id": 1}).
+			SetSkip(int64((query.Page - 1) * query.Limit)).
+			SetLimit(int64(query.Limit))
+		cur, err := usersCollection(db).Find(c, filter, opts)
+		if err != nil {
+			util.InternalServerError(c, err, "users finding err")
+			return
+		}
+
+		users := []data.User{}
+		if err := cur.All(c, &users); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		res := []data.UserResponse{}
+		for _, v := range users {
+			res = append(res, userResponse(v))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"users": res,
+				"total": total,
+				"page":  query.Page,
+				"limit": query.Limit,
+			},
+		})
+	}
+}
+
+// findUser loads the user named in the path and writes a 404 when there is
+// none.
+func findUser(c *gin.Context, db *mongo.Client) (*data.User, bool) {
+	userId, err := bson.ObjectIDFromHex(c.Param("userId"))
+
+	user := &data.User{}
+	if err == nil {
+		err = usersCollection(db).FindOne(c, bson.M{"_id": userId}).Decode(user)
+	}
+	if err != nil {
+		c.JSON(404, gin.H{
+			"success": false,
+			"error":   "User not found",
+		})
+		c.Abort()
+		util.PrintError(err, "user finding err")
+		return nil, false
+	}
+	return user, true
+}
+
+// notSelf stops admins from demoting, deactivating or deleting themselves,
+// which could leave nobody able to manage users.
+func notSelf(c *gin.Context, user *data.User) bool {
+	if user.ID.Hex() == c.GetString("userId") {
+		c.JSON(400, gin.H{
+			"success": false,
+			"error":   "Cannot change your own account",
+		})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+func getUser(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := findUser(c, db)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    userResponse(*user),
+		})
+	}
+}
+
+type UpdateUserRequest struct {
+	Name  *string `json:"name" binding:"omitempty,min=1"`
+	Email *string `json:"email" binding:"omitempty,email"`
+}
+
+func updateUser(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := UpdateUserRequest{}
+		if err := c.ShouldBind(&ReqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		user, ok := findUser(c, db)
+		if !ok {
+			return
+		}
+
+		set := bson.M{}
+		if ReqBody.Name != nil {
+			set["name"] = *ReqBody.Name
+		}
+		if ReqBody.Email != nil && *ReqBody.Email != user.Email {
+			err := usersCollection(db).FindOne(c, bson.M{"email": *ReqBody.Email}).Err()
+			if err == nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Email already exists",
+				})
+				c.Abort()
+				return
+			} else if !errors.Is(err, mongo.ErrNoDocuments) {
+				util.InternalServerError(c, err, "user finding err")
+				return
+			}
+			set["email"] = *ReqBody.Email
+			set["email_verified"] = false
+		}
+		if len(set) == 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+				"data":    userResponse(*user),
+			})
+			return
+		}
+
+		err := usersCollection(db).FindOneAndUpdate(c, bson.M{"_id": user.ID}, bson.M{"$set": set}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(user)
+		if err != nil {
+			util.InternalServerError(c, err, "user update err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    userResponse(*user),
+		})
+	}
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=student teacher admin"`
+}
+
+// setUserRole changes a user's role. Their logins are revoked, since their
+// tokens carry the old role.
+func setUserRole(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := SetRoleRequest{}
+		if err := c.ShouldBind(&ReqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		user, ok := findUser(c, db)
+		if !ok || !notSelf(c, user) {
+			return
+		}
+
+		err := usersCollection(db).FindOneAndUpdate(c, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"role": ReqBody.Role}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(user)
+		if err != nil {
+			util.InternalServerError(c, err, "user update err")
+			return
+		}
+		if err := revokeUserLogins(c, db, hub, user.ID); err != nil {
+			util.InternalServerError(c, err, "revoking logins err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    userResponse(*user),
+		})
+	}
+}
+
+// setUserActive deactivates or reactivates a user. Deactivating also ends
+// their logins and closes their sockets.
+func setUserActive(db *mongo.Client, hub *Hub, active bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := findUser(c, db)
+		if !ok || !notSelf(c, user) {
+			return
+		}
+
+		err := usersCollection(db).FindOneAndUpdate(c, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"deactivated": !active}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(user)
+		if err != nil {
+			util.InternalServerError(c, err, "user update err")
+			return
+		}
+		if !active {
+			if err := revokeUserLogins(c, db, hub, user.ID); err != nil {
+				util.InternalServerError(c, err, "revoking logins err")
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    userResponse(*user),
+		})
+	}
+}
+
+// deleteUser removes a user and takes them off every class roster. Their
+// attendance records are kept. Teachers who still own classes cannot be
+// deleted until the classes are handed over.
+func deleteUser(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := findUser(c, db)
+		if !ok || !notSelf(c, user) {
+			return
+		}
+
+		classes := db.Database("attendance").Collection("class")
+		owned, err := classes.CountDocuments(c, bson.M{"teacher_id": user.ID})
+		if err != nil {
+			util.InternalServerError(c, err, "class counting err")
+			return
+		}
+		if owned > 0 {
+			c.JSON(409, gin.H{
+				"success": false,
+				"error":   "User still teaches classes",
+			})
+			c.Abort()
+			return
+		}
+
+		if err := revokeUserLogins(c, db, hub, user.ID); err != nil {
+			util.InternalServerError(c, err, "revoking logins err")
+			return
+		}
+		if _, err := classes.UpdateMany(c, bson.M{"student_ids": user.ID}, bson.M{"$pull": bson.M{"student_ids": user.ID}}); err != nil {
+			util.InternalServerError(c, err, "class update err")
+			return
+		}
+		if _, err := usersCollection(db).DeleteOne(c, bson.M{"_id": user.ID}); err != nil {
+			util.InternalServerError(c, err, "user deletion err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    userResponse(*user),
+		})
+	}
+}
+
+// listClasses lists every class, optionally those of one teacher.
+func listClasses(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := bson.M{}
+		if raw, exists := c.GetQuery("teacherId"); exists {
+			teacherId, err := bson.ObjectIDFromHex(raw)
+			if err != nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Invalid request schema",
+				})
+				c.Abort()
+				util.PrintError(err, "object id err")
+				return
+			}
+			filter["teacher_id"] = teacherId
+		}
+
+		cur, err := db.Database("attendance").Collection("class").Find(c, filter, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			util.InternalServerError(c, err, "class finding err")
+			return
+		}
+
+		classes := []data.Class{}
+		if err := cur.All(c, &classes); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    classes,
+		})
+	}
+}
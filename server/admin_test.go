@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestAdminRoleAuth(t *testing.T) {
+	tests := []struct {
+		role string
+		code int
+	}{
+		{"admin", 200},
+		{"teacher", 403},
+		{"student", 403},
+		{"", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			code, _ := runHandler(t, AdminRoleAuth(), testRequest{values: map[string]any{"role": tt.role}})
+			if code != tt.code {
+				t.Fatalf("status = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestManagesClass(t *testing.T) {
+	teacher := bson.NewObjectID()
+
+	tests := []struct {
+		name   string
+		userId string
+		role   string
+		want   bool
+	}{
+		{"class's teacher", teacher.Hex(), "teacher", true},
+		{"other teacher", bson.NewObjectID().Hex(), "teacher", false},
+		{"admin", bson.NewObjectID().Hex(), "admin", true},
+		{"student with the teacher's id", teacher.Hex(), "student", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := managesClass(tt.userId, tt.role, teacher); got != tt.want {
+				t.Fatalf("managesClass() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	hub := &Hub{revoke: make(chan []string, 10)}
+
+	admin := data.User{ID: bson.NewObjectID(), Name: "admin", Role: "admin"}
+	teacher := data.User{ID: bson.NewObjectID(), Name: "teacher", Role: "teacher"}
+	student := data.User{ID: bson.NewObjectID(), Name: "student", Role: "student"}
+	class := data.Class{
+		ID:         bson.NewObjectID(),
+		ClassName:  "admin test",
+		TeacherID:  teacher.ID,
+		StudentIDs: []bson.ObjectID{student.ID},
+	}
+	for _, v := range []data.User{admin, teacher, student} {
+		if _, err := usersCollection(db).InsertOne(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	classes := db.Database("attendance").Collection("class")
+	if _, err := classes.InsertOne(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		usersCollection(db).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": []bson.ObjectID{admin.ID, teacher.ID, student.ID}}})
+		classes.DeleteOne(ctx, bson.M{"_id": class.ID})
+	})
+
+	tests := []struct {
+		name    string
+		userId  bson.ObjectID
+		code    int
+		deleted bool
+	}{
+		{"teacher who owns a class", teacher.ID, 409, false},
+		{"themselves", admin.ID, 400, false},
+		{"unknown user", bson.NewObjectID(), 404, false},
+		{"student", student.ID, 200, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reply := runHandler(t, deleteUser(db, hub), testRequest{
+				method: http.MethodDelete,
+				params: gin.Params{{Key: "userId", Value: tt.userId.Hex()}},
+				values: map[string]any{"userId": admin.ID.Hex(), "role": "admin"},
+			})
+			if code != tt.code {
+				t.Fatalf("status = %d, want %d, reply %v", code, tt.code, reply)
+			}
+			if tt.code == 404 {
+				return
+			}
+
+			n, err := usersCollection(db).CountDocuments(ctx, bson.M{"_id": tt.userId})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted := n == 0; deleted != tt.deleted {
+				t.Fatalf("deleted = %v, want %v", deleted, tt.deleted)
+			}
+		})
+	}
+
+	stored := data.Class{}
+	if err := classes.FindOne(ctx, bson.M{"_id": class.ID}).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(stored.StudentIDs, student.ID) {
+		t.Fatal("deleted student still on the class roster")
+	}
+}
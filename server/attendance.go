@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -8,13 +9,17 @@ import (
 	"github.com/dinesht04/ws-attendance/data"
 	"github.com/dinesht04/ws-attendance/util"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 type AttendanceRecord struct {
 	ClassID string  `json:"classId"`
 	Status  *string `json:"status"`
+	// RecordID is set once the session was persisted
+	RecordID string `json:"recordId,omitempty"`
 }
 
 type Response struct {
@@ -22,43 +27,55 @@ type Response struct {
 	Data    *AttendanceRecord `json:"data"`
 }
 
+// getMyAttendance reports the student's status in the class's running
+// session, or in its latest finished one when none is running.
 func getMyAttendance(db *mongo.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id, err := bson.ObjectIDFromHex(c.GetString("userId"))
 		if err != nil {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
+			util.AuthError(c, err, "object id from hex err")
+			return
+		}
+		classId, err := bson.ObjectIDFromHex(c.GetString("classId"))
+		if err != nil {
 			util.InternalServerError(c, err, "object id from hex err")
-			c.Abort()
+			return
+		}
+
+		if session, ok := ActiveSessions.Get(classId.Hex()); ok {
+			session.Lock()
+			mark, marked := session.AttendanceStatus[id.Hex()]
+			session.Unlock()
+
+			record := &AttendanceRecord{ClassID: classId.Hex()}
+			if marked {
+				record.Status = &mark.Status
+			}
+			c.JSON(http.StatusOK, &Response{
+				Success: true,
+				Data:    record,
+			})
 			return
 		}
 
 		filter := bson.M{
-			"_id": id,
+			"classid":   classId,
+			"studentid": id,
 		}
+		opts := options.FindOne().SetSort(bson.M{"_id": -1})
 
 		attendance := data.Attendance{}
-
-		err = db.Database("attendance").Collection("attedances").FindOne(c, filter).Decode(&attendance)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				c.JSON(http.StatusOK, &Response{
-					Success: true,
-					Data: &AttendanceRecord{
-						ClassID: c.GetString("classId"),
-						Status:  nil,
-					},
-				})
-				c.Abort()
-				return
-			}
-			c.JSON(400, gin.H{
-				"success": false,
-				"error":   "Invalid request schema",
+		err = recordsCollection(db).FindOne(c, filter, opts).Decode(&attendance)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusOK, &Response{
+				Success: true,
+				Data: &AttendanceRecord{
+					ClassID: classId.Hex(),
+					Status:  nil,
+				},
 			})
-			c.Abort()
+			return
+		} else if err != nil {
 			util.InternalServerError(c, err, "db search err")
 			return
 		}
@@ -66,14 +83,26 @@ func getMyAttendance(db *mongo.Client) gin.HandlerFunc {
 		c.JSON(http.StatusOK, &Response{
 			Success: true,
 			Data: &AttendanceRecord{
-				ClassID: c.GetString("classId"),
-				Status:  &attendance.Status,
+				ClassID:  classId.Hex(),
+				Status:   &attendance.Status,
+				RecordID: attendance.ID.Hex(),
 			},
 		})
 	}
 }
 
-func startAttendance(db *mongo.Client) gin.HandlerFunc {
+type StartAttendanceRequest struct {
+	ClassID            string `json:"classId" binding:"required"`
+	MaxDurationMinutes int    `json:"maxDurationMinutes" binding:"gte=0"`
+	IdleTimeoutMinutes int    `json:"idleTimeoutMinutes" binding:"gte=0"`
+	OnTimeMinutes      *int   `json:"onTimeMinutes" binding:"omitempty,gte=0"`
+	CutoffMinutes      *int   `json:"cutoffMinutes" binding:"omitempty,gte=0"`
+	// students online for this share of the session are marked present when
+	// it ends; zero turns it off
+	AutoPresentPercent int `json:"autoPresentPercent" binding:"gte=0,lte=100"`
+}
+
+func startAttendance(db *mongo.Client, hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		class, exists := c.Get("classId")
 		if !exists {
@@ -87,16 +116,311 @@ func startAttendance(db *mongo.Client) gin.HandlerFunc {
 		}
 		classId := class.(bson.ObjectID)
 
-		ActiveSession.ClassID = classId
-		ActiveSession.StartedAt = time.Now().UTC().String()
+		req := StartAttendanceRequest{}
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "req bind err")
+			return
+		}
+
+		settings := data.SessionSettings{
+			MaxDuration: DefaultMaxSessionDuration,
+			IdleTimeout: DefaultIdleTimeout,
+		}
+		if req.MaxDurationMinutes > 0 {
+			settings.MaxDuration = time.Duration(req.MaxDurationMinutes) * time.Minute
+		}
+		if req.IdleTimeoutMinutes > 0 {
+			settings.IdleTimeout = time.Duration(req.IdleTimeoutMinutes) * time.Minute
+		}
+
+		// the class's check-in window applies unless the request overrides it
+		window := data.CheckInWindow{}
+		if classWindow, _ := c.Get("checkInWindow"); classWindow != nil {
+			if w, ok := classWindow.(*data.CheckInWindow); ok && w != nil {
+				window = *w
+			}
+		}
+		if req.OnTimeMinutes != nil {
+			window.OnTimeMinutes = *req.OnTimeMinutes
+		}
+		if req.CutoffMinutes != nil {
+			window.CutoffMinutes = *req.CutoffMinutes
+		}
+		if !validCheckInWindow(window) {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Cutoff must not be before the on-time window ends",
+			})
+			c.Abort()
+			return
+		}
+		settings.OnTimeWindow = time.Duration(window.OnTimeMinutes) * time.Minute
+		settings.Cutoff = time.Duration(window.CutoffMinutes) * time.Minute
+		settings.AutoPresentShare = float64(req.AutoPresentPercent) / 100
+
+		teacherId, _ := bson.ObjectIDFromHex(c.GetString("teacherId"))
+		studentIds, _ := c.Get("studentIds")
+		customStatuses, _ := c.Get("customStatuses")
+		location, _ := c.Get("location")
+		rollCallPolicy, _ := c.Get("rollCallPolicy")
+
+		rules := SessionRules{}
+		rules.CustomStatuses, _ = customStatuses.([]data.StatusRule)
+		rules.Location, _ = location.(*data.ClassLocation)
+		rules.RollCallPolicy, _ = rollCallPolicy.(*data.RollCallPolicy)
+
+		session, err := ActiveSessions.Start(classId, teacherId, studentIds.([]bson.ObjectID), settings, rules)
+		if err != nil {
+			c.JSON(409, gin.H{
+				"success": false,
+				"error":   "Attendance session already running",
+			})
+			c.Abort()
+			return
+		}
+
+		session.Lock()
+		err = saveSession(db, session)
+		session.Unlock()
+		if err != nil {
+			ActiveSessions.Remove(session)
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "session insertion err")
+			return
+		}
+
+		hub.resetPresence(classId.Hex(), session.LastActivityAt)
+		broadcastSessionEvent(hub, c.GetString("userId"), "SESSION_STARTED", session)
 
 		c.JSON(http.StatusOK, gin.H{
 			"success": true,
 			"data": gin.H{
-				"classId":   ActiveSession.ClassID,
-				"startedAt": ActiveSession.StartedAt,
+				"classId":     session.ClassID,
+				"startedAt":   session.StartedAt,
+				"expiresAt":   session.ExpiresAt,
+				"onTimeUntil": session.OnTimeUntil,
+				"cutoffAt":    session.CutoffAt,
 			},
 		})
 
 	}
 }
+
+// sessionFromContext looks up the running session of the class resolved by
+// ClassBodyBasedAuth and writes a 404 when there is none.
+func sessionFromContext(c *gin.Context) (*data.Session, bool) {
+	class, _ := c.Get("classId")
+	classId, _ := class.(bson.ObjectID)
+
+	session, ok := ActiveSessions.Get(classId.Hex())
+	if !ok {
+		c.JSON(404, gin.H{
+			"success": false,
+			"error":   "No active attendance session",
+		})
+		c.Abort()
+		return nil, false
+	}
+	return session, true
+}
+
+func sessionData(session *data.Session) WsSessionData {
+	session.Lock()
+	defer session.Unlock()
+
+	return WsSessionData{
+		ClassID:   session.ClassID.Hex(),
+		StartedAt: session.StartedAt,
+		Paused:    session.Paused,
+	}
+}
+
+func broadcastSessionEvent(hub *Hub, userId string, event string, session *data.Session) {
+	hub.broadcast <- &Message{
+		ClientID: userId,
+		ClassID:  session.ClassID.Hex(),
+		Type:     event,
+		Text: WsSession{
+			Event: event,
+			Data:  sessionData(session),
+		},
+	}
+}
+
+func broadcastDone(hub *Hub, userId string, session *data.Session, done WsDone) {
+	hub.broadcast <- &Message{
+		ClientID: userId,
+		ClassID:  session.ClassID.Hex(),
+		Type:     "DONE",
+		Text:     done,
+	}
+}
+
+func getCurrentSession(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := sessionFromContext(c)
+		if !ok {
+			return
+		}
+
+		session.Lock()
+		summary := summarizeSession(session)
+		session.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"session": sessionData(session),
+				"summary": summary,
+			},
+		})
+	}
+}
+
+func endAttendance(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := sessionFromContext(c)
+		if !ok {
+			return
+		}
+
+		done, err := finalizeSession(db, hub, session)
+		if errors.Is(err, ErrSessionFinalized) {
+			c.JSON(409, gin.H{
+				"success": false,
+				"error":   "Attendance already persisted",
+			})
+			c.Abort()
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "finalizing session err")
+			return
+		}
+
+		broadcastDone(hub, c.GetString("userId"), session, done)
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    done.Data,
+		})
+	}
+}
+
+// cancelAttendance throws the running session away without storing any
+// records. Only an open session can be cancelled, so a session that DONE or
+// expiry already persisted stays persisted.
+func cancelAttendance(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := sessionFromContext(c)
+		if !ok {
+			return
+		}
+
+		session.Lock()
+		if session.State != data.SessionOpen {
+			session.Unlock()
+			c.JSON(409, gin.H{
+				"success": false,
+				"error":   "Attendance already persisted",
+			})
+			c.Abort()
+			return
+		}
+
+		res, err := sessionsCollection(db).DeleteOne(c, bson.M{"_id": session.ID, "state": data.SessionOpen})
+		if err != nil {
+			session.Unlock()
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "session deletion err")
+			return
+		}
+		if res.DeletedCount == 0 {
+			session.Unlock()
+			c.JSON(409, gin.H{
+				"success": false,
+				"error":   "Attendance already persisted",
+			})
+			c.Abort()
+			return
+		}
+		session.State = data.SessionCancelled
+		ActiveSessions.Remove(session)
+		session.Unlock()
+
+		broadcastSessionEvent(hub, c.GetString("userId"), "SESSION_CANCELLED", session)
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    sessionData(session),
+		})
+	}
+}
+
+// pauseAttendance pauses or resumes marking in the running session.
+func pauseAttendance(db *mongo.Client, hub *Hub, pause bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := sessionFromContext(c)
+		if !ok {
+			return
+		}
+
+		session.Lock()
+		if session.Paused == pause {
+			session.Unlock()
+			msg := "Session already running"
+			if pause {
+				msg = "Session already paused"
+			}
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   msg,
+			})
+			c.Abort()
+			return
+		}
+		session.Paused = pause
+		session.LastActivityAt = time.Now().UTC()
+		err := saveSession(db, session)
+		if err != nil {
+			session.Paused = !pause
+			session.Unlock()
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "session update err")
+			return
+		}
+		session.Unlock()
+
+		event := "SESSION_RESUMED"
+		if pause {
+			event = "SESSION_PAUSED"
+		}
+		broadcastSessionEvent(hub, c.GetString("userId"), event, session)
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    sessionData(session),
+		})
+	}
+}
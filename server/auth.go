@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/mail"
 	"github.com/dinesht04/ws-attendance/util"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -13,8 +14,6 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-const secret = "golang"
-
 type SignUpRequest struct {
 	Name     string `json:"name" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
@@ -22,7 +21,8 @@ type SignUpRequest struct {
 	Role     string `json:"role" binding:"required,oneof=student teacher"`
 }
 
-func HandleSignup(db *mongo.Client) gin.HandlerFunc {
+// HandleSignup creates the user and mails them a link to verify their email.
+func HandleSignup(db *mongo.Client, mailer mail.Mailer) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		reqBody := SignUpRequest{}
 		if err := c.ShouldBind(&reqBody); err != nil {
@@ -68,10 +68,11 @@ func HandleSignup(db *mongo.Client) gin.HandlerFunc {
 		}
 
 		res, err := collection.InsertOne(context.Background(), bson.M{
-			"name":     reqBody.Name,
-			"email":    reqBody.Email,
-			"password": hashedPass,
-			"role":     reqBody.Role,
+			"name":           reqBody.Name,
+			"email":          reqBody.Email,
+			"password":       hashedPass,
+			"role":           reqBody.Role,
+			"email_verified": false,
 		})
 		if err != nil {
 			c.JSON(400, gin.H{
@@ -83,6 +84,13 @@ func HandleSignup(db *mongo.Client) gin.HandlerFunc {
 			return
 		}
 
+		userId, _ := res.InsertedID.(bson.ObjectID)
+		go sendEmailToken(db, mailer, data.User{
+			ID:    userId,
+			Name:  reqBody.Name,
+			Email: reqBody.Email,
+		}, data.VerifyEmail)
+
 		c.JSON(201, gin.H{
 			"success": true,
 			"data": gin.H{
@@ -101,7 +109,9 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required,gte=6"`
 }
 
-func HandleLogin(db *mongo.Client) gin.HandlerFunc {
+// HandleLogin signs the user in. Failed attempts are limited per client IP,
+// and an account that keeps failing is locked out for longer each time.
+func HandleLogin(db *mongo.Client, limits *LoginLimits) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		reqBody := LoginRequest{}
 		if err := c.ShouldBind(&reqBody); err != nil {
@@ -114,6 +124,10 @@ func HandleLogin(db *mongo.Client) gin.HandlerFunc {
 			return
 		}
 
+		if !checkLoginLimits(c, limits, reqBody.Email) {
+			return
+		}
+
 		filter := bson.M{"email": reqBody.Email}
 		User := data.User{}
 
@@ -121,32 +135,37 @@ func HandleLogin(db *mongo.Client) gin.HandlerFunc {
 
 		err := collection.FindOne(context.Background(), filter).Decode(&User)
 		if err != nil {
-			c.JSON(400, gin.H{
-				"success": false,
-				"error":   "Invalid email or password",
-			})
+			loginFailed(c, db, limits, reqBody.Email)
 			util.PrintError(err, "Searching for user err")
-			c.Abort()
 			return
 		}
 
 		err = bcrypt.CompareHashAndPassword([]byte(User.Password), []byte(reqBody.Password))
 		if err != nil {
-			c.JSON(400, gin.H{
+			loginFailed(c, db, limits, reqBody.Email)
+			return
+		}
+		if err := clearAccountLockout(c, db, limits, reqBody.Email, UnlockedByLogin, nil); err != nil {
+			util.PrintError(err, "clearing lockout err")
+		}
+		if User.Deactivated {
+			c.JSON(403, gin.H{
 				"success": false,
-				"error":   "Invalid email or password",
+				"error":   "Account deactivated",
+			})
+			c.Abort()
+			return
+		}
+		if requireEmailVerification() && !User.EmailVerified {
+			c.JSON(403, gin.H{
+				"success": false,
+				"error":   "Email not verified",
 			})
 			c.Abort()
 			return
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"userId": User.ID,
-			"role":   User.Role,
-		})
-
-		// Sign and get the complete encoded token as a string using the secret
-		tokenString, err := token.SignedString([]byte(secret))
+		tokenString, refreshToken, err := issueTokens(c, db, User, "")
 		if err != nil {
 			c.JSON(http.StatusOK, gin.H{
 				"success": false,
@@ -154,14 +173,10 @@ func HandleLogin(db *mongo.Client) gin.HandlerFunc {
 			})
 			util.PrintError(err, "SIgning jwt err")
 			c.Abort()
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"success": true,
-			"data": gin.H{
-				"token": tokenString,
-			},
-		})
+		tokenResponse(c, tokenString, refreshToken)
 	}
 
 }
@@ -169,6 +184,8 @@ func HandleLogin(db *mongo.Client) gin.HandlerFunc {
 type MyClaims struct {
 	UserId string `json:"userId"`
 	Role   string `json:"role"`
+	// SessionID is the login the token was issued for
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
@@ -186,10 +203,7 @@ func HandleMe(db *mongo.Client) gin.HandlerFunc {
 		}
 
 		//parse jwt here
-		token, err := jwt.Parse(authHeader, func(token *jwt.Token) (any, error) {
-			// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-			return []byte(secret), nil
-		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		claims, err := verifyAccessToken(c, db, authHeader)
 		if err != nil {
 			c.JSON(401, gin.H{
 				"success": false,
@@ -200,29 +214,7 @@ func HandleMe(db *mongo.Client) gin.HandlerFunc {
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			util.PrintError(err, "extracting claims error")
-			c.Abort()
-			return
-		}
-
-		userId, ok := claims["userId"].(string)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			util.PrintError(err, "Token is not string")
-			c.Abort()
-			return
-		}
-
-		objId, _ := bson.ObjectIDFromHex(userId)
+		objId, _ := bson.ObjectIDFromHex(claims.UserId)
 
 		filter := bson.M{"_id": objId}
 		User := data.User{}
@@ -241,10 +233,11 @@ func HandleMe(db *mongo.Client) gin.HandlerFunc {
 		}
 
 		type Datares struct {
-			ID    string `json:"_id"`
-			Name  string `json:"name"`
-			Email string `json:"email"`
-			Role  string `json:"role"`
+			ID            string `json:"_id"`
+			Name          string `json:"name"`
+			Email         string `json:"email"`
+			Role          string `json:"role"`
+			EmailVerified bool   `json:"emailVerified"`
 		}
 
 		type MeRes struct {
@@ -253,10 +246,11 @@ func HandleMe(db *mongo.Client) gin.HandlerFunc {
 		}
 
 		res := Datares{
-			ID:    User.ID.Hex(),
-			Name:  User.Name,
-			Email: User.Email,
-			Role:  User.Role,
+			ID:            User.ID.Hex(),
+			Name:          User.Name,
+			Email:         User.Email,
+			Role:          User.Role,
+			EmailVerified: User.EmailVerified,
 		}
 
 		c.JSON(http.StatusOK, MeRes{
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// WsBulkMarkData lists explicit marks, and optionally a status for every
+// roster student still without a mark after them.
+type WsBulkMarkData struct {
+	Marks     []AttendanceData `json:"marks"`
+	Remaining string           `json:"remaining"`
+}
+
+type WsBulkMark struct {
+	Event string         `json:"event"`
+	Data  WsBulkMarkData `json:"data"`
+}
+
+type WsBulkMarkedData struct {
+	Marks []AttendanceData `json:"marks"`
+}
+
+type WsBulkMarked struct {
+	Event string           `json:"event"`
+	Data  WsBulkMarkedData `json:"data"`
+}
+
+// bulkMarks validates a bulk mark against the session and works out the
+// marks to apply. Nothing is applied if any entry is invalid. The caller must
+// hold the session lock.
+func bulkMarks(session *data.Session, req WsBulkMarkData) (data.AttendanceStatus, error) {
+	roster := map[string]bool{}
+	for _, v := range session.StudentIDs {
+		roster[v.Hex()] = true
+	}
+
+	now := time.Now().UTC()
+	marks := data.AttendanceStatus{}
+	for _, v := range req.Marks {
+		if !roster[v.StudentID] {
+			return nil, fmt.Errorf("student %s not enrolled in class", v.StudentID)
+		}
+		if _, ok := marks[v.StudentID]; ok {
+			return nil, fmt.Errorf("student %s listed twice", v.StudentID)
+		}
+		if _, ok := data.FindStatusRule(session.CustomStatuses, v.Status); !ok {
+			return nil, fmt.Errorf("invalid status %s", v.Status)
+		}
+		marks[v.StudentID] = data.Mark{Status: v.Status, MarkedAt: now, Method: MarkedByTeacher}
+	}
+
+	if req.Remaining != "" {
+		if _, ok := data.FindStatusRule(session.CustomStatuses, req.Remaining); !ok {
+			return nil, fmt.Errorf("invalid status %s", req.Remaining)
+		}
+		for _, v := range session.StudentIDs {
+			if _, ok := marks[v.Hex()]; ok {
+				continue
+			}
+			if _, ok := session.AttendanceStatus[v.Hex()]; ok {
+				continue
+			}
+			marks[v.Hex()] = data.Mark{Status: req.Remaining, MarkedAt: now, Method: MarkedByTeacher}
+		}
+	}
+	return marks, nil
+}
+
+// wsBulkMark handles the BULK_MARK event. All marks are saved in one write
+// and go out to the room as a single BULK_MARKED event.
+func (c *Client) wsBulkMark(db *mongo.Client, req WsReq) {
+	session, msg := c.teacherSession(req)
+	if session == nil {
+		c.sendError(req.RequestID, msg)
+		return
+	}
+
+	jsonData, _ := json.Marshal(req)
+	var bulk WsBulkMark
+	if err := json.Unmarshal(jsonData, &bulk); err != nil || (len(bulk.Data.Marks) == 0 && bulk.Data.Remaining == "") {
+		c.sendError(req.RequestID, "Invalid format")
+		return
+	}
+
+	session.Lock()
+	if session.Paused {
+		session.Unlock()
+		c.sendError(req.RequestID, "Attendance session is paused")
+		return
+	}
+	marks, err := bulkMarks(session, bulk.Data)
+	if err != nil {
+		session.Unlock()
+		c.sendError(req.RequestID, err.Error())
+		return
+	}
+	if len(marks) > 0 {
+		if err := saveMarks(db, session, marks); err != nil {
+			session.Unlock()
+			util.PrintError(err, "saving bulk marks err")
+			c.sendError(req.RequestID, "Could not save attendance")
+			return
+		}
+	}
+	applied := []AttendanceData{}
+	for studentId, mark := range marks {
+		session.AttendanceStatus[studentId] = mark
+		applied = append(applied, AttendanceData{StudentID: studentId, Status: mark.Status})
+	}
+	session.Unlock()
+
+	c.hub.broadcast <- &Message{
+		Type:     "BULK_MARKED",
+		ClientID: c.id,
+		ClassID:  session.ClassID.Hex(),
+		Text: WsBulkMarked{
+			Event: "BULK_MARKED",
+			Data: WsBulkMarkedData{
+				Marks: applied,
+			},
+		},
+	}
+	c.ack(req)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestBulkMarks(t *testing.T) {
+	s := []string{bson.NewObjectID().Hex(), bson.NewObjectID().Hex(), bson.NewObjectID().Hex()}
+	session := &data.Session{
+		CustomStatuses: []data.StatusRule{{Name: "field trip", CountsAs: data.CountsAsPresent}},
+		AttendanceStatus: data.AttendanceStatus{
+			s[2]: {Status: data.StatusLate, MarkedAt: time.Now().UTC()},
+		},
+	}
+	for _, v := range s {
+		id, _ := bson.ObjectIDFromHex(v)
+		session.StudentIDs = append(session.StudentIDs, id)
+	}
+
+	tests := []struct {
+		name string
+		req  WsBulkMarkData
+		// student -> status of the marks to apply, nil when refused
+		want map[string]string
+	}{
+		{"explicit marks", WsBulkMarkData{Marks: []AttendanceData{
+			{StudentID: s[0], Status: data.StatusPresent},
+			{StudentID: s[1], Status: "field trip"},
+		}}, map[string]string{s[0]: data.StatusPresent, s[1]: "field trip"}},
+		{"remaining skips marked students", WsBulkMarkData{
+			Marks:     []AttendanceData{{StudentID: s[0], Status: data.StatusExcused}},
+			Remaining: data.StatusAbsent,
+		}, map[string]string{s[0]: data.StatusExcused, s[1]: data.StatusAbsent}},
+		{"explicit mark overrides an earlier one", WsBulkMarkData{Marks: []AttendanceData{
+			{StudentID: s[2], Status: data.StatusPresent},
+		}}, map[string]string{s[2]: data.StatusPresent}},
+		{"student not on the roster", WsBulkMarkData{Marks: []AttendanceData{
+			{StudentID: s[0], Status: data.StatusPresent},
+			{StudentID: bson.NewObjectID().Hex(), Status: data.StatusPresent},
+		}}, nil},
+		{"student listed twice", WsBulkMarkData{Marks: []AttendanceData{
+			{StudentID: s[0], Status: data.StatusPresent},
+			{StudentID: s[0], Status: data.StatusAbsent},
+		}}, nil},
+		{"unknown status", WsBulkMarkData{Marks: []AttendanceData{
+			{StudentID: s[0], Status: "asleep"},
+		}}, nil},
+		{"unknown remaining status", WsBulkMarkData{Remaining: "asleep"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marks, err := bulkMarks(session, tt.req)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("bulkMarks() = %v, want an error", marks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(marks) != len(tt.want) {
+				t.Fatalf("%d marks, want %d", len(marks), len(tt.want))
+			}
+			for studentId, status := range tt.want {
+				if mark := marks[studentId]; mark.Status != status || mark.Method != MarkedByTeacher {
+					t.Errorf("mark of %s = %s by %s, want %s by %s", studentId, mark.Status, mark.Method, status, MarkedByTeacher)
+				}
+			}
+			if len(session.AttendanceStatus) != 1 {
+				t.Fatal("bulkMarks() changed the session")
+			}
+		})
+	}
+}
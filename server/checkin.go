@@ -0,0 +1,408 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// CheckInCodeStep is how long a check-in code stays on screen.
+	CheckInCodeStep   = 10 * time.Second
+	checkInCodeDigits = 6
+	// maxCheckInFailures is how many wrong codes a student may send in a
+	// session before code check-in is closed to them; the teacher can still
+	// mark them
+	maxCheckInFailures = 5
+)
+
+var (
+	ErrInvalidCode   = errors.New("invalid check-in code")
+	ErrNotEnrolled   = errors.New("student not enrolled in class")
+	ErrSessionPaused = errors.New("attendance session is paused")
+	ErrAlreadyMarked = errors.New("attendance already marked")
+	ErrMarkNotSaved  = errors.New("could not save attendance")
+	ErrCheckInClosed = errors.New("check-in closed for this session")
+	ErrTooManyCodes  = errors.New("too many wrong check-in codes, ask your teacher to mark you")
+)
+
+func newCheckInSecret() []byte {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return secret
+}
+
+// checkInCode derives the code for a time step from the session secret, the
+// same way HOTP/TOTP codes are derived.
+func checkInCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < checkInCodeDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", checkInCodeDigits, value%mod)
+}
+
+func checkInStep(t time.Time) int64 {
+	return t.Unix() / int64(CheckInCodeStep/time.Second)
+}
+
+// validCheckInCode accepts the current code and the one before it, so a code
+// read out just before it rotates still works.
+func validCheckInCode(secret []byte, code string, now time.Time) bool {
+	step := checkInStep(now)
+	for _, s := range []int64{step, step - 1} {
+		if hmac.Equal([]byte(checkInCode(secret, s)), []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// how a mark was taken
+const (
+	MarkedByTeacher  = "teacher"
+	CheckInByCode    = "code"
+	CheckInByQR      = "qr"
+	MarkedByPresence = "presence"
+)
+
+// CheckInAttempt is a student marking themselves present. QR attempts carry
+// a token the handler already verified, so they have no code.
+type CheckInAttempt struct {
+	StudentID string
+	Method    string
+	Code      string
+	Location  *data.Coordinates
+	Device    data.Device
+}
+
+// checkIn validates the attempt against the session and records the mark.
+// A check-in from a device other students already checked in from still goes
+// through, but comes back with a flag.
+func checkIn(db *mongo.Client, session *data.Session, attempt CheckInAttempt) (data.Mark, *data.CheckInFlag, error) {
+	session.Lock()
+	defer session.Unlock()
+
+	enrolled := false
+	for _, v := range session.StudentIDs {
+		if v.Hex() == attempt.StudentID {
+			enrolled = true
+		}
+	}
+	if !enrolled {
+		return data.Mark{}, nil, ErrNotEnrolled
+	}
+	if session.Paused {
+		return data.Mark{}, nil, ErrSessionPaused
+	}
+	if attempt.Method == CheckInByCode {
+		if session.FailedCheckIns[attempt.StudentID] >= maxCheckInFailures {
+			return data.Mark{}, nil, ErrTooManyCodes
+		}
+		if !validCheckInCode(session.CheckInSecret, attempt.Code, time.Now()) {
+			if session.FailedCheckIns == nil {
+				session.FailedCheckIns = make(map[string]int)
+			}
+			session.FailedCheckIns[attempt.StudentID]++
+			return data.Mark{}, nil, ErrInvalidCode
+		}
+	}
+	if _, ok := session.AttendanceStatus[attempt.StudentID]; ok {
+		return data.Mark{}, nil, ErrAlreadyMarked
+	}
+
+	now := time.Now().UTC()
+	if !session.CutoffAt.IsZero() && now.After(session.CutoffAt) {
+		return data.Mark{}, nil, ErrCheckInClosed
+	}
+
+	status := data.StatusPresent
+	if !session.OnTimeUntil.IsZero() && now.After(session.OnTimeUntil) {
+		status = data.StatusLate
+	}
+
+	mark := data.Mark{
+		Status:   status,
+		MarkedAt: now,
+		Method:   attempt.Method,
+		Location: attempt.Location,
+		Device:   &attempt.Device,
+	}
+	if session.Location != nil {
+		distance, err := checkGeofence(session.Location, attempt.Location)
+		if err != nil {
+			return data.Mark{}, nil, err
+		}
+		mark.DistanceMeters = &distance
+	}
+
+	flag := detectSharedDevice(session, attempt)
+
+	if err := saveMark(db, session, attempt.StudentID, mark); err != nil {
+		util.PrintError(err, "saving check-in err")
+		return data.Mark{}, nil, ErrMarkNotSaved
+	}
+	session.AttendanceStatus[attempt.StudentID] = mark
+
+	return mark, flag, nil
+}
+
+// checkInSucceeded tells the class room about the check-in and raises the
+// flag if the device looked shared.
+func checkInSucceeded(db *mongo.Client, hub *Hub, studentId string, session *data.Session, mark data.Mark, flag *data.CheckInFlag) {
+	broadcastCheckIn(hub, studentId, session, mark)
+	if flag != nil {
+		reportSuspiciousCheckIn(db, hub, flag)
+	}
+}
+
+func broadcastCheckIn(hub *Hub, studentId string, session *data.Session, mark data.Mark) {
+	hub.broadcast <- &Message{
+		ClientID: studentId,
+		ClassID:  session.ClassID.Hex(),
+		Type:     "CHECKED_IN",
+		Text: WsAttendanceMarkReq{
+			Event: "CHECKED_IN",
+			Data: AttendanceData{
+				StudentID: studentId,
+				Status:    mark.Status,
+			},
+		},
+	}
+}
+
+// checkInFailed reports a rejected check-in to the teacher's room when it
+// looks like an attempt from outside the classroom.
+func checkInFailed(hub *Hub, studentId string, session *data.Session, err error) {
+	var fenceErr *GeofenceError
+	if errors.As(err, &fenceErr) {
+		notifyFlaggedCheckIn(hub, studentId, session, fenceErr)
+	}
+}
+
+// checkInErrorStatus maps a check-in error to its HTTP status code.
+func checkInErrorStatus(err error) int {
+	var fenceErr *GeofenceError
+	if errors.As(err, &fenceErr) {
+		return 403
+	}
+
+	switch err {
+	case ErrNotEnrolled, ErrCheckInClosed:
+		return 403
+	case ErrAlreadyMarked:
+		return 409
+	case ErrTooManyCodes:
+		return http.StatusTooManyRequests
+	case ErrMarkNotSaved:
+		return 500
+	default:
+		return 400
+	}
+}
+
+// getCheckInCode shows the teacher the code that is currently valid.
+func getCheckInCode(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := sessionFromContext(c)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		session.Lock()
+		code := checkInCode(session.CheckInSecret, checkInStep(now))
+		session.Unlock()
+
+		step := int64(CheckInCodeStep / time.Second)
+		expiresIn := step - now.Unix()%step
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"code":      code,
+				"expiresIn": expiresIn,
+			},
+		})
+	}
+}
+
+type CheckInRequest struct {
+	ClassID  string            `json:"classId" binding:"required"`
+	Code     string            `json:"code" binding:"required"`
+	Location *data.Coordinates `json:"location"`
+	DeviceID string            `json:"deviceId"`
+}
+
+func handleCheckIn(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := CheckInRequest{}
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "req bind err")
+			return
+		}
+
+		session, ok := sessionFromContext(c)
+		if !ok {
+			return
+		}
+
+		studentId := c.GetString("userId")
+		mark, flag, err := checkIn(db, session, CheckInAttempt{
+			StudentID: studentId,
+			Method:    CheckInByCode,
+			Code:      req.Code,
+			Location:  req.Location,
+			Device:    requestDevice(c, req.DeviceID),
+		})
+		if err != nil {
+			checkInFailed(hub, studentId, session, err)
+			c.JSON(checkInErrorStatus(err), gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
+		checkInSucceeded(db, hub, studentId, session, mark, flag)
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"classId": session.ClassID.Hex(),
+				"mark":    mark,
+			},
+		})
+	}
+}
+
+// wsCheckIn handles the CHECK_IN event from a student's socket.
+func (c *Client) wsCheckIn(db *mongo.Client, req WsReq) {
+	if c.role != "student" {
+		c.sendError(req.RequestID, "Forbidden, student event only")
+		return
+	}
+
+	session, msg := c.activeSession(req)
+	if session == nil {
+		c.sendError(req.RequestID, msg)
+		return
+	}
+
+	jsonData, _ := json.Marshal(req)
+	var checkInReq WsCheckIn
+	if err := json.Unmarshal(jsonData, &checkInReq); err != nil || checkInReq.Data.Code == "" {
+		c.sendError(req.RequestID, "Invalid format")
+		return
+	}
+
+	mark, flag, err := checkIn(db, session, CheckInAttempt{
+		StudentID: c.id,
+		Method:    CheckInByCode,
+		Code:      checkInReq.Data.Code,
+		Location:  checkInReq.Data.Location,
+		Device: data.Device{
+			IP:        c.ip,
+			UserAgent: c.userAgent,
+			DeviceID:  checkInReq.Data.DeviceID,
+		},
+	})
+	if err != nil {
+		checkInFailed(c.hub, c.id, session, err)
+		c.sendError(req.RequestID, err.Error())
+		return
+	}
+
+	checkInSucceeded(db, c.hub, c.id, session, mark, flag)
+	c.ack(req)
+}
+
+// validCheckInWindow checks that the cutoff does not come before the end of
+// the on-time window. Zero means no limit.
+func validCheckInWindow(window data.CheckInWindow) bool {
+	return window.CutoffMinutes == 0 || window.CutoffMinutes >= window.OnTimeMinutes
+}
+
+// SetCheckInWindow sets the class's default check-in window. It applies to
+// sessions started afterwards.
+func SetCheckInWindow(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := data.CheckInWindow{}
+
+		err := c.ShouldBind(&ReqBody)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+		if !validCheckInWindow(ReqBody) {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Cutoff must not be before the on-time window ends",
+			})
+			c.Abort()
+			return
+		}
+
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+		update := bson.M{
+			"$set": bson.M{
+				"checkin_window": ReqBody,
+			},
+		}
+
+		var updatedClass data.Class
+		err = db.Database("attendance").Collection("class").FindOneAndUpdate(c, bson.M{"_id": classId}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updatedClass)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "checkin window update err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"checkInWindow": updatedClass.CheckInWindow,
+			},
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestCheckInCodeHOTP(t *testing.T) {
+	// the HOTP test values from RFC 4226, appendix D
+	secret := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for step, code := range want {
+		if got := checkInCode(secret, int64(step)); got != code {
+			t.Errorf("checkInCode(step %d) = %s, want %s", step, got, code)
+		}
+	}
+}
+
+func TestValidCheckInCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Date(2026, 3, 2, 9, 30, 5, 0, time.UTC)
+	step := checkInStep(now)
+
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"current code", checkInCode(secret, step), true},
+		{"previous code", checkInCode(secret, step-1), true},
+		{"two codes back", checkInCode(secret, step-2), false},
+		{"next code", checkInCode(secret, step+1), false},
+		{"other session's code", checkInCode([]byte("another secret"), step), false},
+		{"empty", "", false},
+		{"current code with extra digit", checkInCode(secret, step) + "0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validCheckInCode(secret, tt.code, now); got != tt.valid {
+				t.Fatalf("validCheckInCode() = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCheckInStep(t *testing.T) {
+	base := time.Unix(1_000_000_000, 0)
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		same   bool
+	}{
+		{"same instant", 0, true},
+		{"within the step", CheckInCodeStep - time.Second, true},
+		{"next step", CheckInCodeStep, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkInStep(base) == checkInStep(base.Add(tt.offset)); got != tt.same {
+				t.Fatalf("same step = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestCheckInWrongCodeLockout(t *testing.T) {
+	student, other := bson.NewObjectID(), bson.NewObjectID()
+	session := &data.Session{
+		StudentIDs:       []bson.ObjectID{student, other},
+		CheckInSecret:    newCheckInSecret(),
+		AttendanceStatus: make(data.AttendanceStatus),
+	}
+	attempt := func(studentId bson.ObjectID, code string) error {
+		_, _, err := checkIn(nil, session, CheckInAttempt{
+			StudentID: studentId.Hex(),
+			Method:    CheckInByCode,
+			Code:      code,
+		})
+		return err
+	}
+
+	for i := 1; i <= maxCheckInFailures; i++ {
+		if err := attempt(student, "000000x"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("wrong code %d err = %v, want %v", i, err, ErrInvalidCode)
+		}
+	}
+
+	session.Lock()
+	code := checkInCode(session.CheckInSecret, checkInStep(time.Now()))
+	session.Unlock()
+
+	tests := []struct {
+		name    string
+		student bson.ObjectID
+		code    string
+		err     error
+	}{
+		{"locked out with a wrong code", student, "000000x", ErrTooManyCodes},
+		{"locked out with the right code", student, code, ErrTooManyCodes},
+		{"other student still gets tries", other, "000000x", ErrInvalidCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := attempt(tt.student, tt.code); !errors.Is(err, tt.err) {
+				t.Fatalf("checkIn() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -15,6 +16,9 @@ import (
 
 type CreateClassRequest struct {
 	ClassName string `json:"className" binding:"required"`
+	// TeacherID names the teacher of a class an admin creates; teachers always
+	// teach the classes they create
+	TeacherID string `json:"teacherId"`
 }
 
 func CreateClass(db *mongo.Client) gin.HandlerFunc {
@@ -45,10 +49,31 @@ func CreateClass(db *mongo.Client) gin.HandlerFunc {
 
 		}
 
+		teacherId := userId
+		if c.GetString("role") == "admin" {
+			teacherId, err = bson.ObjectIDFromHex(ReqBody.TeacherID)
+			if err == nil {
+				err = usersCollection(db).FindOne(c, bson.M{"_id": teacherId, "role": "teacher"}).Err()
+			}
+			if err != nil && !errors.Is(err, bson.ErrInvalidHex) && err != mongo.ErrNoDocuments {
+				util.InternalServerError(c, err, "class teacher lookup err")
+				return
+			}
+			if err != nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "teacherId must name a teacher",
+				})
+				c.Abort()
+				util.PrintError(err, "class teacher err")
+				return
+			}
+		}
+
 		NewClass := data.Class{
 			ID:         bson.NewObjectID(),
 			ClassName:  ReqBody.ClassName,
-			TeacherID:  userId,
+			TeacherID:  teacherId,
 			StudentIDs: []bson.ObjectID{},
 		}
 
@@ -69,7 +94,7 @@ func CreateClass(db *mongo.Client) gin.HandlerFunc {
 			"data": gin.H{
 				"_id":        res.InsertedID,
 				"className":  NewClass.ClassName,
-				"teacherId":  userId,
+				"teacherId":  teacherId,
 				"studentIds": emptyArray,
 			},
 		})
@@ -115,7 +140,7 @@ func AddStudent(db *mongo.Client) gin.HandlerFunc {
 			return
 		}
 
-		if result.TeacherID.Hex() != c.GetString("userId") {
+		if !managesClass(c.GetString("userId"), c.GetString("role"), result.TeacherID) {
 			c.JSON(403, gin.H{
 				"success": false,
 				"error":   "Forbidden, not class teacher",
@@ -258,3 +283,70 @@ func GetClass(db *mongo.Client) gin.HandlerFunc {
 
 	}
 }
+
+type CustomStatusesRequest struct {
+	Statuses []data.StatusRule `json:"statuses" binding:"dive"`
+}
+
+// SetCustomStatuses replaces the class's custom statuses. They apply to
+// sessions started afterwards.
+func SetCustomStatuses(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := CustomStatusesRequest{}
+
+		err := c.ShouldBind(&ReqBody)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		seen := map[string]bool{}
+		for _, v := range ReqBody.Statuses {
+			if data.IsBuiltinStatus(v.Name) || seen[v.Name] {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Duplicate status " + v.Name,
+				})
+				c.Abort()
+				return
+			}
+			seen[v.Name] = true
+		}
+		if ReqBody.Statuses == nil {
+			ReqBody.Statuses = []data.StatusRule{}
+		}
+
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+		update := bson.M{
+			"$set": bson.M{
+				"custom_statuses": ReqBody.Statuses,
+			},
+		}
+
+		var updatedClass data.Class
+		err = db.Database("attendance").Collection("class").FindOneAndUpdate(c, bson.M{"_id": classId}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updatedClass)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "custom statuses update err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"builtinStatuses": data.BuiltinStatuses,
+				"customStatuses":  updatedClass.CustomStatuses,
+			},
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var ErrRecordChanged = errors.New("record changed concurrently")
+
+func recordsCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("records")
+}
+
+func recordHistoryCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("record_history")
+}
+
+// changeRecordStatus updates a persisted record and appends the change to its
+// history, then recounts the session summary. It needs no transaction, so it
+// works on a standalone MongoDB.
+func changeRecordStatus(ctx context.Context, db *mongo.Client, record *data.Attendance, status string, reason string, changedBy bson.ObjectID) (*data.RecordChange, error) {
+	change := &data.RecordChange{
+		ID:        bson.NewObjectID(),
+		RecordID:  record.ID,
+		SessionID: record.SessionID,
+		ClassID:   record.ClassID,
+		StudentID: record.StudentID,
+		OldStatus: record.Status,
+		NewStatus: status,
+		Reason:    reason,
+		ChangedBy: changedBy,
+		ChangedAt: time.Now().UTC(),
+	}
+
+	// the update only applies while the record still has the status it was
+	// read with, so of two concurrent corrections only one goes through
+	guard := bson.M{
+		"_id":    record.ID,
+		"status": record.Status,
+	}
+	res, err := recordsCollection(db).UpdateOne(ctx, guard, bson.M{"$set": bson.M{"status": status}})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrRecordChanged
+	}
+
+	if _, err := recordHistoryCollection(db).InsertOne(ctx, change); err != nil {
+		// a change without history is put back, unless it was changed again
+		revert := bson.M{
+			"_id":    record.ID,
+			"status": status,
+		}
+		if _, revertErr := recordsCollection(db).UpdateOne(ctx, revert, bson.M{"$set": bson.M{"status": record.Status}}); revertErr != nil {
+			util.PrintError(revertErr, "reverting record err")
+		}
+		return nil, err
+	}
+
+	record.Status = status
+	if err := refreshSessionSummary(ctx, db, record.SessionID); err != nil {
+		util.PrintError(err, "refreshing session summary err")
+	}
+	return change, nil
+}
+
+// findRecord loads the record named in the path. Students can only see their
+// own records.
+func findRecord(c *gin.Context, db *mongo.Client) (*data.Attendance, bool) {
+	recordId, err := bson.ObjectIDFromHex(c.Param("recordId"))
+	classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+	record := &data.Attendance{}
+	if err == nil {
+		err = recordsCollection(db).FindOne(c, bson.M{"_id": recordId, "classid": classId}).Decode(record)
+	}
+	if err == nil && c.GetString("role") == "student" && record.StudentID.Hex() != c.GetString("userId") {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		c.JSON(404, gin.H{
+			"success": false,
+			"error":   "Record not found",
+		})
+		c.Abort()
+		util.PrintError(err, "record finding err")
+		return nil, false
+	}
+	return record, true
+}
+
+type CorrectRecordRequest struct {
+	Status string `json:"status" binding:"required"`
+	Reason string `json:"reason" binding:"required"`
+}
+
+// correctRecord lets the teacher fix the status of a persisted record.
+func correctRecord(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := CorrectRecordRequest{}
+		if err := c.ShouldBind(&ReqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		record, ok := findRecord(c, db)
+		if !ok {
+			return
+		}
+
+		// the statuses valid for the record are the ones its session ran with
+		session := data.Session{}
+		err := sessionsCollection(db).FindOne(c, bson.M{"_id": record.SessionID}).Decode(&session)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			util.InternalServerError(c, err, "session finding err")
+			return
+		}
+		if _, ok := data.FindStatusRule(session.CustomStatuses, ReqBody.Status); !ok {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid status",
+			})
+			c.Abort()
+			return
+		}
+		if record.Status == ReqBody.Status {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Record already has this status",
+			})
+			c.Abort()
+			return
+		}
+
+		changedBy, _ := bson.ObjectIDFromHex(c.GetString("userId"))
+		change, err := changeRecordStatus(c, db, record, ReqBody.Status, ReqBody.Reason, changedBy)
+		if errors.Is(err, ErrRecordChanged) {
+			c.JSON(409, gin.H{
+				"success": false,
+				"error":   "Record was changed by someone else, reload it",
+			})
+			c.Abort()
+			return
+		} else if err != nil {
+			util.InternalServerError(c, err, "record correction err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"record": record,
+				"change": change,
+			},
+		})
+	}
+}
+
+// getRecord returns a persisted record with its full change history.
+func getRecord(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record, ok := findRecord(c, db)
+		if !ok {
+			return
+		}
+
+		cur, err := recordHistoryCollection(db).Find(c, bson.M{"record_id": record.ID}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			util.InternalServerError(c, err, "record history finding err")
+			return
+		}
+
+		history := []data.RecordChange{}
+		if err := cur.All(c, &history); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"record":  record,
+				"history": history,
+			},
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestChangeRecordStatusGuard(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// corrections made at once, each from the same copy of the record
+		concurrent []string
+		want       int
+	}{
+		{"single correction", []string{data.StatusPresent}, 1},
+		{"same correction twice", []string{data.StatusPresent, data.StatusPresent}, 1},
+		{"racing corrections", []string{data.StatusPresent, data.StatusLate, data.StatusExcused, data.StatusPresent, data.StatusLate}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := data.Attendance{
+				ID:        bson.NewObjectID(),
+				SessionID: bson.NewObjectID(),
+				ClassID:   bson.NewObjectID(),
+				StudentID: bson.NewObjectID(),
+				Status:    data.StatusAbsent,
+				MarkedAt:  time.Now().UTC(),
+			}
+			if _, err := recordsCollection(db).InsertOne(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				recordsCollection(db).DeleteOne(ctx, bson.M{"_id": record.ID})
+				recordHistoryCollection(db).DeleteMany(ctx, bson.M{"record_id": record.ID})
+			})
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(tt.concurrent))
+			for i, status := range tt.concurrent {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					snapshot := record
+					_, errs[i] = changeRecordStatus(ctx, db, &snapshot, status, "test", bson.NewObjectID())
+				}()
+			}
+			wg.Wait()
+
+			applied := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					applied++
+				case !errors.Is(err, ErrRecordChanged):
+					t.Fatalf("changeRecordStatus() err = %v", err)
+				}
+			}
+			if applied != tt.want {
+				t.Fatalf("%d corrections applied, want %d", applied, tt.want)
+			}
+
+			history, err := recordHistoryCollection(db).CountDocuments(ctx, bson.M{"record_id": record.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if history != int64(tt.want) {
+				t.Fatalf("%d history entries, want %d", history, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/mail"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// environment variables mail is configured with
+const (
+	// SMTPHostEnv turns on SMTP delivery. Without it mail goes to the outbox
+	// directory.
+	SMTPHostEnv     = "SMTP_HOST"
+	SMTPPortEnv     = "SMTP_PORT"
+	SMTPUsernameEnv = "SMTP_USERNAME"
+	SMTPPasswordEnv = "SMTP_PASSWORD"
+	MailFromEnv     = "MAIL_FROM"
+	// AppBaseURLEnv is the client app the links in mails point at. Its
+	// /verify-email and /reset-password pages post the token to the API.
+	// Without it no link mails are sent.
+	AppBaseURLEnv = "APP_BASE_URL"
+	// RequireEmailVerificationEnv set to "true" refuses logins with an
+	// unverified email.
+	RequireEmailVerificationEnv = "REQUIRE_EMAIL_VERIFICATION"
+)
+
+const (
+	MailOutboxDir = "outbox"
+
+	VerifyEmailTokenLifetime   = 24 * time.Hour
+	ResetPasswordTokenLifetime = time.Hour
+
+	// mailTimeout bounds issuing and sending one mail in the background.
+	mailTimeout = 30 * time.Second
+)
+
+var ErrInvalidEmailToken = errors.New("invalid or expired token")
+
+// NewMailer sends through SMTP when SMTP_HOST is set and into the local
+// outbox otherwise. Requiring verified emails needs APP_BASE_URL, or no one
+// could get the link.
+func NewMailer() (mail.Mailer, error) {
+	if requireEmailVerification() && !appLinksEnabled() {
+		return nil, fmt.Errorf("%s needs %s to point at the client app the mails link to", RequireEmailVerificationEnv, AppBaseURLEnv)
+	}
+
+	host := os.Getenv(SMTPHostEnv)
+	if host == "" {
+		return mail.NewOutbox(MailOutboxDir)
+	}
+
+	port := os.Getenv(SMTPPortEnv)
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv(MailFromEnv)
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	return mail.NewSMTPMailer(host, port, os.Getenv(SMTPUsernameEnv), os.Getenv(SMTPPasswordEnv), from), nil
+}
+
+func requireEmailVerification() bool {
+	return os.Getenv(RequireEmailVerificationEnv) == "true"
+}
+
+func emailTokensCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("email_tokens")
+}
+
+// issueEmailToken stores a new token for the user, replacing any unused one
+// with the same purpose.
+func issueEmailToken(ctx context.Context, db *mongo.Client, user data.User, purpose string, lifetime time.Duration) (string, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"user_id": user.ID,
+		"purpose": purpose,
+		"used_at": bson.M{"$exists": false},
+	}
+	if _, err := emailTokensCollection(db).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}); err != nil {
+		return "", err
+	}
+
+	token := newOpaqueToken()
+	_, err := emailTokensCollection(db).InsertOne(ctx, data.EmailToken{
+		ID:        bson.NewObjectID(),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Hash:      hashToken(token),
+		Email:     user.Email,
+		ExpiresAt: now.Add(lifetime),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeEmailToken spends a token, so it works only once.
+func consumeEmailToken(ctx context.Context, db *mongo.Client, raw string, purpose string) (*data.EmailToken, error) {
+	now := time.Now().UTC()
+	guard := bson.M{
+		"hash":       hashToken(raw),
+		"purpose":    purpose,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}
+
+	token := &data.EmailToken{}
+	err := emailTokensCollection(db).FindOneAndUpdate(ctx, guard, bson.M{"$set": bson.M{"used_at": now}}).Decode(token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidEmailToken
+	}
+	return token, err
+}
+
+// appLinksEnabled reports whether APP_BASE_URL is set, so links to the client
+// app can be made.
+func appLinksEnabled() bool {
+	return strings.TrimRight(os.Getenv(AppBaseURLEnv), "/") != ""
+}
+
+// appLink links to a page of the client app, which passes the token on to
+// the API. It is empty when APP_BASE_URL is not set.
+func appLink(path string, token string) string {
+	base := strings.TrimRight(os.Getenv(AppBaseURLEnv), "/")
+	if base == "" {
+		return ""
+	}
+	return base + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendEmailToken mails the user a fresh token. It runs in the background so
+// the response does not reveal whether the address has an account. Nothing
+// is sent when APP_BASE_URL is not set, since the mail would have no link.
+func sendEmailToken(db *mongo.Client, mailer mail.Mailer, user data.User, purpose string) {
+	if !appLinksEnabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	msg := mail.Message{To: user.Email}
+	var token string
+	var err error
+	switch purpose {
+	case data.VerifyEmail:
+		token, err = issueEmailToken(ctx, db, user, purpose, VerifyEmailTokenLifetime)
+		msg.Subject = "Verify your email"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening this link:\n\n%s\n\nThe link expires in 24 hours.\n", user.Name, appLink("/verify-email", token))
+	case data.ResetPassword:
+		token, err = issueEmailToken(ctx, db, user, purpose, ResetPasswordTokenLifetime)
+		msg.Subject = "Reset your password"
+		msg.Body = fmt.Sprintf("Hi %s,\n\nSomeone asked to reset your password. If it was you, open this link:\n\n%s\n\nThe link expires in 1 hour. If it was not you, ignore this mail.\n", user.Name, appLink("/reset-password", token))
+	}
+	if err != nil {
+		util.PrintError(err, "issuing email token err")
+		return
+	}
+
+	if err := mailer.Send(ctx, msg); err != nil {
+		util.PrintError(err, "sending mail err")
+	}
+}
+
+type EmailTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// VerifyEmail marks the address the token was sent to as verified.
+func VerifyEmail(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reqBody := EmailTokenRequest{}
+		if err := c.ShouldBind(&reqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			util.PrintError(err, "Validaton and Binding err")
+			c.Abort()
+			return
+		}
+
+		token, err := consumeEmailToken(c, db, reqBody.Token, data.VerifyEmail)
+		if err != nil && !errors.Is(err, ErrInvalidEmailToken) {
+			util.InternalServerError(c, err, "email token err")
+			return
+		}
+
+		if err == nil {
+			filter := bson.M{"_id": token.UserID, "email": token.Email}
+			res, updateErr := usersCollection(db).UpdateOne(c, filter, bson.M{"$set": bson.M{"email_verified": true}})
+			if updateErr != nil {
+				util.InternalServerError(c, updateErr, "user update err")
+				return
+			}
+			if res.MatchedCount == 0 {
+				// the address changed after the mail went out
+				err = ErrInvalidEmailToken
+			}
+		}
+		if err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid or expired token",
+			})
+			c.Abort()
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"emailVerified": true,
+			},
+		})
+	}
+}
+
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// emailRequestHandler answers the same way whether or not the address has an
+// account, and only mails users that send accepts. Requests are limited per
+// client IP and per address. Without APP_BASE_URL there is no link to mail,
+// so it answers 503.
+func emailRequestHandler(db *mongo.Client, mailer mail.Mailer, limits *LoginLimits, purpose string, send func(data.User) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !appLinksEnabled() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"success": false,
+				"error":   "Email links are not configured",
+			})
+			c.Abort()
+			return
+		}
+
+		reqBody := EmailRequest{}
+		if err := c.ShouldBind(&reqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			util.PrintError(err, "Validaton and Binding err")
+			c.Abort()
+			return
+		}
+
+		if !mailRequested(c, db, limits, reqBody.Email) {
+			return
+		}
+
+		User := data.User{}
+		err := usersCollection(db).FindOne(c, bson.M{"email": reqBody.Email}).Decode(&User)
+		if err == nil && send(User) {
+			go sendEmailToken(db, mailer, User, purpose)
+		} else if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			util.PrintError(err, "Searching for user err")
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"message": "If the address has an account, a mail is on its way",
+			},
+		})
+	}
+}
+
+// ResendVerification mails a new verification link to an unverified user.
+func ResendVerification(db *mongo.Client, mailer mail.Mailer, limits *LoginLimits) gin.HandlerFunc {
+	return emailRequestHandler(db, mailer, limits, data.VerifyEmail, func(user data.User) bool {
+		return !user.EmailVerified && !user.Deactivated
+	})
+}
+
+// ForgotPassword mails a password reset link.
+func ForgotPassword(db *mongo.Client, mailer mail.Mailer, limits *LoginLimits) gin.HandlerFunc {
+	return emailRequestHandler(db, mailer, limits, data.ResetPassword, func(user data.User) bool {
+		return !user.Deactivated
+	})
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,gte=6"`
+}
+
+// ResetPassword sets a new password and ends every login of the user. Using
+// the mailed link also proves the address, so it is marked verified and any
+// lockout on the account is cleared.
+func ResetPassword(db *mongo.Client, hub *Hub, limits *LoginLimits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reqBody := ResetPasswordRequest{}
+		if err := c.ShouldBind(&reqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			util.PrintError(err, "Validaton and Binding err")
+			c.Abort()
+			return
+		}
+
+		token, err := consumeEmailToken(c, db, reqBody.Token, data.ResetPassword)
+		if errors.Is(err, ErrInvalidEmailToken) {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid or expired token",
+			})
+			c.Abort()
+			return
+		} else if err != nil {
+			util.InternalServerError(c, err, "email token err")
+			return
+		}
+
+		hashedPass, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), 5)
+		if err != nil {
+			util.InternalServerError(c, err, "Password Hashing error")
+			return
+		}
+
+		filter := bson.M{"_id": token.UserID, "email": token.Email}
+		update := bson.M{
+			"$set": bson.M{
+				"password":       hashedPass,
+				"email_verified": true,
+			},
+		}
+		res, err := usersCollection(db).UpdateOne(c, filter, update)
+		if err != nil {
+			util.InternalServerError(c, err, "user update err")
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid or expired token",
+			})
+			c.Abort()
+			return
+		}
+
+		if err := revokeUserLogins(c, db, hub, token.UserID); err != nil {
+			util.PrintError(err, "revoking logins err")
+		}
+		if err := clearAccountLockout(c, db, limits, token.Email, UnlockedByPasswordReset, nil); err != nil {
+			util.PrintError(err, "clearing lockout err")
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"message": "Password updated, log in again",
+			},
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	DefaultMaxSessionDuration = 3 * time.Hour
+	DefaultIdleTimeout        = 30 * time.Minute
+
+	expiryCheckInterval = 30 * time.Second
+	// maxFinalizeAttempts is how many checks in a row may fail to finalize an
+	// expired session before it is dropped from memory. It stays in the
+	// database, so the next start loads it and tries again.
+	maxFinalizeAttempts = 10
+)
+
+// sessionExpired reports whether the session ran past its maximum duration or
+// sat idle for too long. Paused sessions only expire on the maximum duration.
+// Sessions whose records were not all written are always due.
+func sessionExpired(session *data.Session, now time.Time) bool {
+	session.Lock()
+	defer session.Unlock()
+
+	if session.State == data.SessionClosing {
+		return true
+	}
+	if !session.ExpiresAt.IsZero() && now.After(session.ExpiresAt) {
+		return true
+	}
+	if session.Paused || session.Settings.IdleTimeout == 0 {
+		return false
+	}
+	return now.Sub(session.LastActivityAt) > session.Settings.IdleTimeout
+}
+
+// expireSessions finalizes sessions that were left open, doing the same work
+// as the DONE event.
+func expireSessions(db *mongo.Client, hub *Hub) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	failures := map[bson.ObjectID]int{}
+	for now := range ticker.C {
+		for _, session := range ActiveSessions.All() {
+			if !sessionExpired(session, now.UTC()) {
+				continue
+			}
+			expireSession(db, hub, session, failures)
+		}
+	}
+}
+
+// expireSession finalizes an expired session. failures counts the failed
+// attempts in a row per session, so one that keeps failing is given up on
+// instead of being retried forever.
+func expireSession(db *mongo.Client, hub *Hub, session *data.Session, failures map[bson.ObjectID]int) {
+	done, err := finalizeSession(db, hub, session)
+	switch {
+	case err == nil:
+		delete(failures, session.ID)
+		broadcastDone(hub, session.TeacherID.Hex(), session, done)
+	case errors.Is(err, ErrSessionFinalized):
+		delete(failures, session.ID)
+		ActiveSessions.Remove(session)
+	case errors.Is(err, mongo.ErrNoDocuments):
+		// the class was deleted, so there is no roster to finish it with
+		delete(failures, session.ID)
+		util.PrintError(err, "dropping session of deleted class")
+		dropSession(db, hub, session)
+	default:
+		failures[session.ID]++
+		util.PrintError(err, "auto finalizing session err")
+		if failures[session.ID] >= maxFinalizeAttempts {
+			delete(failures, session.ID)
+			util.PrintError(err, "giving up on finalizing session "+session.ID.Hex())
+			ActiveSessions.Remove(session)
+		}
+	}
+}
+
+// dropSession cancels a session that can not be finalized, the way cancelling
+// it by hand does.
+func dropSession(db *mongo.Client, hub *Hub, session *data.Session) {
+	session.Lock()
+	filter := bson.M{
+		"_id":   session.ID,
+		"state": bson.M{"$in": []string{data.SessionOpen, data.SessionClosing}},
+	}
+	if _, err := sessionsCollection(db).DeleteOne(context.Background(), filter); err != nil {
+		util.PrintError(err, "session deletion err")
+	}
+	session.State = data.SessionCancelled
+	ActiveSessions.Remove(session)
+	session.Unlock()
+
+	broadcastSessionEvent(hub, session.TeacherID.Hex(), "SESSION_CANCELLED", session)
+}
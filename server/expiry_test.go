@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestExpireSessionGivesUp(t *testing.T) {
+	// nothing listens there, so every finalize attempt fails
+	db, err := mongo.Connect(options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Disconnect(context.Background())
+
+	classId := bson.NewObjectID()
+	session, err := ActiveSessions.Start(classId, bson.NewObjectID(), nil, data.SessionSettings{}, SessionRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ActiveSessions.Remove(session) })
+
+	failures := map[bson.ObjectID]int{}
+	for i := 1; i < maxFinalizeAttempts; i++ {
+		expireSession(db, nil, session, failures)
+		if _, ok := ActiveSessions.Get(classId.Hex()); !ok {
+			t.Fatalf("session dropped after %d failed attempts", i)
+		}
+	}
+
+	expireSession(db, nil, session, failures)
+	if _, ok := ActiveSessions.Get(classId.Hex()); ok {
+		t.Fatalf("session still running after %d failed attempts", maxFinalizeAttempts)
+	}
+	if len(failures) != 0 {
+		t.Fatalf("failures = %v, want none left", failures)
+	}
+}
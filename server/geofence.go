@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const earthRadiusMeters = 6371000
+
+var ErrLocationRequired = errors.New("location required for check-in")
+
+// GeofenceError rejects a check-in made outside the class radius.
+type GeofenceError struct {
+	Location       data.Coordinates
+	DistanceMeters float64
+	RadiusMeters   float64
+}
+
+func (e *GeofenceError) Error() string {
+	return fmt.Sprintf("check-in %.0fm away, outside the %.0fm class radius", e.DistanceMeters, e.RadiusMeters)
+}
+
+// distanceMeters is the haversine distance between two points.
+func distanceMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// checkGeofence returns how far the check-in was from the class, or an error
+// when it has no coordinates or falls outside the radius.
+func checkGeofence(fence *data.ClassLocation, at *data.Coordinates) (float64, error) {
+	if at == nil {
+		return 0, ErrLocationRequired
+	}
+
+	distance := distanceMeters(fence.Latitude, fence.Longitude, at.Latitude, at.Longitude)
+	if distance > fence.RadiusMeters {
+		return distance, &GeofenceError{
+			Location:       *at,
+			DistanceMeters: distance,
+			RadiusMeters:   fence.RadiusMeters,
+		}
+	}
+	return distance, nil
+}
+
+type WsFlaggedCheckInData struct {
+	StudentID      string           `json:"studentID"`
+	Reason         string           `json:"reason"`
+	Location       data.Coordinates `json:"location"`
+	DistanceMeters float64          `json:"distanceMeters"`
+}
+
+type WsFlaggedCheckIn struct {
+	Event string               `json:"event"`
+	Data  WsFlaggedCheckInData `json:"data"`
+}
+
+func (w WsFlaggedCheckIn) EventName() string { return w.Event }
+
+// notifyFlaggedCheckIn tells the teacher about a check-in from outside the
+// geofence. It carries the student's coordinates, so the room never sees it.
+func notifyFlaggedCheckIn(hub *Hub, studentId string, session *data.Session, fenceErr *GeofenceError) {
+	hub.sendToTeachers(session.ClassID.Hex(), WsFlaggedCheckIn{
+		Event: "CHECKIN_FLAGGED",
+		Data: WsFlaggedCheckInData{
+			StudentID:      studentId,
+			Reason:         "outside geofence",
+			Location:       fenceErr.Location,
+			DistanceMeters: fenceErr.DistanceMeters,
+		},
+	})
+}
+
+// SetClassLocation sets the geofence for self check-ins. It applies to
+// sessions started afterwards.
+func SetClassLocation(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := data.ClassLocation{}
+
+		err := c.ShouldBind(&ReqBody)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		updateClassLocation(c, db, bson.M{"$set": bson.M{"location": ReqBody}})
+	}
+}
+
+func ClearClassLocation(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		updateClassLocation(c, db, bson.M{"$unset": bson.M{"location": ""}})
+	}
+}
+
+func updateClassLocation(c *gin.Context, db *mongo.Client, update bson.M) {
+	classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+	var updatedClass data.Class
+	err := db.Database("attendance").Collection("class").FindOneAndUpdate(c, bson.M{"_id": classId}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updatedClass)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"success": false,
+			"error":   "Internal Server Error",
+		})
+		c.Abort()
+		util.PrintError(err, "class location update err")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"location": updatedClass.Location,
+		},
+	})
+}
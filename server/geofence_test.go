@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/dinesht04/ws-attendance/data"
+)
+
+func TestDistanceMeters(t *testing.T) {
+	// a degree along a great circle on the sphere the formula uses
+	degree := earthRadiusMeters * math.Pi / 180
+
+	tests := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		want, tolerance        float64
+	}{
+		{"same point", 12.9716, 77.5946, 12.9716, 77.5946, 0, 0.001},
+		{"a degree of latitude", 0, 0, 1, 0, degree, 0.01},
+		{"a degree of longitude on the equator", 0, 0, 0, 1, degree, 0.01},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, degree, 0.01},
+		{"antipodes", 0, 0, 0, 180, 180 * degree, 0.01},
+		{"over the pole", 89.9, 0, 89.9, 180, 0.2 * degree, 0.01},
+		{"london to paris", 51.5074, -0.1278, 48.8566, 2.3522, 343_556, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := distanceMeters(tt.lat1, tt.lng1, tt.lat2, tt.lng2)
+			if math.Abs(got-tt.want) > tt.tolerance {
+				t.Fatalf("distanceMeters() = %.3f, want %.3f", got, tt.want)
+			}
+			if back := distanceMeters(tt.lat2, tt.lng2, tt.lat1, tt.lng1); math.Abs(back-got) > 0.001 {
+				t.Fatalf("distance back = %.3f, want %.3f", back, got)
+			}
+		})
+	}
+}
+
+func TestCheckGeofence(t *testing.T) {
+	fence := &data.ClassLocation{Latitude: 0, Longitude: 0, RadiusMeters: 100}
+	// one meter as degrees of latitude
+	meter := 180 / (earthRadiusMeters * math.Pi)
+
+	tests := []struct {
+		name string
+		at   *data.Coordinates
+		err  error
+		// outside is set when the check-in falls outside the radius
+		outside bool
+	}{
+		{"no location", nil, ErrLocationRequired, false},
+		{"at the center", &data.Coordinates{}, nil, false},
+		{"inside", &data.Coordinates{Latitude: 50 * meter}, nil, false},
+		{"just inside the edge", &data.Coordinates{Latitude: 99.9 * meter}, nil, false},
+		{"just outside the edge", &data.Coordinates{Latitude: 100.1 * meter}, nil, true},
+		{"far away", &data.Coordinates{Latitude: 1, Longitude: 1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := checkGeofence(fence, tt.at)
+
+			var fenceErr *GeofenceError
+			if outside := errors.As(err, &fenceErr); outside != tt.outside {
+				t.Fatalf("checkGeofence() err = %v, want outside = %v", err, tt.outside)
+			}
+			if !tt.outside && !errors.Is(err, tt.err) {
+				t.Fatalf("checkGeofence() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
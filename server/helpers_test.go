@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// MongoTestURIEnv points the tests that need MongoDB at a server. They write
+// to its attendance database, so use a throwaway one. Without it those tests
+// are skipped.
+const MongoTestURIEnv = "MONGODB_TEST_URI"
+
+func testMongo(t *testing.T) *mongo.Client {
+	t.Helper()
+	uri := os.Getenv(MongoTestURIEnv)
+	if uri == "" {
+		t.Skip(MongoTestURIEnv + " not set")
+	}
+	db, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Disconnect(context.Background()) })
+	return db
+}
+
+// useTestKeys signs and verifies tokens with an HS256 secret until the test
+// ends.
+func useTestKeys(t *testing.T, secret string) {
+	t.Helper()
+	keys, err := NewKeySet(KeysConfig{
+		SigningKey: "test",
+		Keys:       []KeyConfig{{ID: "test", Algorithm: "HS256", Secret: secret}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := signingKeys
+	signingKeys = keys
+	t.Cleanup(func() { signingKeys = saved })
+}
+
+// testRequest describes a call to a handler: what the auth middleware would
+// have put in the context, the path params and an optional JSON body.
+type testRequest struct {
+	method string
+	body   any
+	params gin.Params
+	values map[string]any
+}
+
+// runHandler calls the handler with the request and decodes its JSON reply.
+func runHandler(t *testing.T, handler gin.HandlerFunc, req testRequest) (int, map[string]any) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	var body bytes.Buffer
+	if req.body != nil {
+		if err := json.NewEncoder(&body).Encode(req.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	method := req.method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, "/", &body)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = req.params
+	for k, v := range req.values {
+		c.Set(k, v)
+	}
+	handler(c)
+
+	reply := map[string]any{}
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("reply %q is not JSON: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, reply
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type SessionSummaryResponse struct {
+	ID        string `json:"_id"`
+	ClassID   string `json:"classId"`
+	TeacherID string `json:"teacherId"`
+	StartedAt string `json:"startedAt"`
+	EndedAt   string `json:"endedAt"`
+	// Summary counts the whole class, so students do not get it
+	Summary *data.SessionSummary `json:"summary,omitempty"`
+}
+
+type SessionStudentStatus struct {
+	// RecordID is what corrections and record history are looked up by
+	RecordID  string `json:"recordId"`
+	StudentID string `json:"studentId"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Status    string `json:"status"`
+}
+
+func sessionSummaryResponse(c *gin.Context, session *data.Session) *SessionSummaryResponse {
+	res := &SessionSummaryResponse{
+		ID:        session.ID.Hex(),
+		ClassID:   session.ClassID.Hex(),
+		TeacherID: session.TeacherID.Hex(),
+		StartedAt: session.StartedAt,
+		EndedAt:   session.EndedAt,
+	}
+	if c.GetString("role") != "student" {
+		res.Summary = &session.Summary
+	}
+	return res
+}
+
+func getClassSessions(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+		filter := bson.M{
+			"class_id": classId,
+			"state":    data.SessionFinished,
+		}
+
+		cur, err := sessionsCollection(db).Find(c, filter, options.Find().SetSort(bson.M{"_id": -1}))
+		if err != nil {
+			util.InternalServerError(c, err, "sessions finding err")
+			return
+		}
+
+		sessions := []*data.Session{}
+		if err := cur.All(c, &sessions); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		res := []*SessionSummaryResponse{}
+		for _, v := range sessions {
+			res = append(res, sessionSummaryResponse(c, v))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    res,
+		})
+	}
+}
+
+// getClassSession returns one past session with the status of every student.
+// Students only get their own status back.
+func getClassSession(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionId, err := bson.ObjectIDFromHex(c.Param("sessionId"))
+		if err != nil {
+			c.JSON(404, gin.H{
+				"success": false,
+				"error":   "Session not found",
+			})
+			c.Abort()
+			util.PrintError(err, "object id err")
+			return
+		}
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+		session := data.Session{}
+		filter := bson.M{
+			"_id":      sessionId,
+			"class_id": classId,
+			"state":    data.SessionFinished,
+		}
+		err = sessionsCollection(db).FindOne(c, filter).Decode(&session)
+		if err != nil {
+			c.JSON(404, gin.H{
+				"success": false,
+				"error":   "Session not found",
+			})
+			c.Abort()
+			util.PrintError(err, "session finding err")
+			return
+		}
+
+		recordFilter := bson.M{"sessionid": sessionId}
+		if c.GetString("role") == "student" {
+			studentId, _ := bson.ObjectIDFromHex(c.GetString("userId"))
+			recordFilter["studentid"] = studentId
+		}
+
+		cur, err := recordsCollection(db).Find(c, recordFilter)
+		if err != nil {
+			util.InternalServerError(c, err, "records finding err")
+			return
+		}
+
+		records := []data.Attendance{}
+		if err := cur.All(c, &records); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		studentIds := []bson.ObjectID{}
+		for _, v := range records {
+			studentIds = append(studentIds, v.StudentID)
+		}
+
+		cur, err = db.Database("attendance").Collection("users").Find(c, bson.M{"_id": bson.M{"$in": studentIds}})
+		if err != nil {
+			util.InternalServerError(c, err, "users finding err")
+			return
+		}
+
+		students := []data.User{}
+		if err := cur.All(c, &students); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		users := make(map[bson.ObjectID]data.User)
+		for _, v := range students {
+			users[v.ID] = v
+		}
+
+		statuses := []*SessionStudentStatus{}
+		for _, v := range records {
+			statuses = append(statuses, &SessionStudentStatus{
+				RecordID:  v.ID.Hex(),
+				StudentID: v.StudentID.Hex(),
+				Name:      users[v.StudentID].Name,
+				Email:     users[v.StudentID].Email,
+				Status:    v.Status,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"session":  sessionSummaryResponse(c, &session),
+				"students": statuses,
+			},
+		})
+	}
+}
+
+// refreshSessionSummary recounts a finished session's summary from its
+// records after they were changed.
+func refreshSessionSummary(ctx context.Context, db *mongo.Client, sessionId bson.ObjectID) error {
+	session := data.Session{}
+	if err := sessionsCollection(db).FindOne(ctx, bson.M{"_id": sessionId}).Decode(&session); err != nil {
+		return err
+	}
+
+	cur, err := recordsCollection(db).Find(ctx, bson.M{"sessionid": sessionId})
+	if err != nil {
+		return err
+	}
+
+	records := []data.Attendance{}
+	if err := cur.All(ctx, &records); err != nil {
+		return err
+	}
+
+	statuses := data.AttendanceStatus{}
+	for _, v := range records {
+		statuses[v.StudentID.Hex()] = data.Mark{Status: v.Status}
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"summary": data.Summarize(statuses, session.CustomStatuses),
+		},
+	}
+	_, err = sessionsCollection(db).UpdateByID(ctx, sessionId, update)
+	return err
+}
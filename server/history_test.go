@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestGetClassSessionRecordIds(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+
+	classId := bson.NewObjectID()
+	session := &data.Session{
+		ID:      bson.NewObjectID(),
+		State:   data.SessionFinished,
+		ClassID: classId,
+		Summary: data.SessionSummary{Present: 1, Absent: 1, Total: 2},
+	}
+	if err := saveSession(db, session); err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]data.Attendance{}
+	for _, status := range []string{data.StatusPresent, data.StatusAbsent} {
+		record := data.Attendance{
+			ID:        bson.NewObjectID(),
+			SessionID: session.ID,
+			ClassID:   classId,
+			StudentID: bson.NewObjectID(),
+			Status:    status,
+			MarkedAt:  time.Now().UTC(),
+		}
+		if _, err := recordsCollection(db).InsertOne(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+		records[record.StudentID.Hex()] = record
+	}
+	t.Cleanup(func() {
+		sessionsCollection(db).DeleteOne(ctx, bson.M{"_id": session.ID})
+		recordsCollection(db).DeleteMany(ctx, bson.M{"sessionid": session.ID})
+	})
+
+	code, reply := runHandler(t, getClassSession(db), testRequest{
+		params: gin.Params{{Key: "sessionId", Value: session.ID.Hex()}},
+		values: map[string]any{"classId": classId.Hex(), "role": "teacher"},
+	})
+	if code != 200 {
+		t.Fatalf("status = %d, reply %v", code, reply)
+	}
+
+	students := reply["data"].(map[string]any)["students"].([]any)
+	if len(students) != len(records) {
+		t.Fatalf("%d students, want %d", len(students), len(records))
+	}
+	for _, v := range students {
+		student := v.(map[string]any)
+		record := records[student["studentId"].(string)]
+		if student["recordId"] != record.ID.Hex() {
+			t.Errorf("recordId = %v, want %s", student["recordId"], record.ID.Hex())
+		}
+	}
+}
+
+func TestClassSessionsSummaryHiddenFromStudents(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+
+	classId, studentId := bson.NewObjectID(), bson.NewObjectID()
+	session := &data.Session{
+		ID:      bson.NewObjectID(),
+		State:   data.SessionFinished,
+		ClassID: classId,
+		Summary: data.SessionSummary{Present: 1, Absent: 1, Total: 2},
+	}
+	if err := saveSession(db, session); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sessionsCollection(db).DeleteOne(ctx, bson.M{"_id": session.ID}) })
+
+	tests := []struct {
+		role    string
+		summary bool
+	}{
+		{"teacher", true},
+		{"student", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			values := map[string]any{"classId": classId.Hex(), "role": tt.role, "userId": studentId.Hex()}
+
+			code, reply := runHandler(t, getClassSessions(db), testRequest{values: values})
+			if code != 200 {
+				t.Fatalf("list status = %d, reply %v", code, reply)
+			}
+			listed := reply["data"].([]any)[0].(map[string]any)
+			if _, ok := listed["summary"]; ok != tt.summary {
+				t.Errorf("listed session has summary = %v, want %v", ok, tt.summary)
+			}
+
+			code, reply = runHandler(t, getClassSession(db), testRequest{
+				params: gin.Params{{Key: "sessionId", Value: session.ID.Hex()}},
+				values: values,
+			})
+			if code != 200 {
+				t.Fatalf("session status = %d, reply %v", code, reply)
+			}
+			one := reply["data"].(map[string]any)["session"].(map[string]any)
+			if _, ok := one["summary"]; ok != tt.summary {
+				t.Errorf("session has summary = %v, want %v", ok, tt.summary)
+			}
+		})
+	}
+}
@@ -2,32 +2,71 @@ package server
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan WsEvent
-	id   string
-	role string
+	hub     *Hub
+	conn    *websocket.Conn
+	send    chan WsEvent
+	id      string
+	role    string
+	classId string
+	// where the socket was opened from, for check-in fingerprints
+	ip        string
+	userAgent string
+	// the access token the socket was opened with
+	jti string
+	sid string
 }
 
 type Message struct {
 	ClientID string
+	ClassID  string
 	Type     string
 	Text     WsEvent
 }
 
+// DirectMessage goes only to the listed users' sockets in the class room, and
+// to its teacher and admin sockets when Teachers is set. It is not sequenced
+// or logged, since nobody else would miss it.
+type DirectMessage struct {
+	ClassID  string
+	UserIDs  []string
+	Teachers bool
+	Text     WsEvent
+}
+
+// eventLogSize is how many broadcasts each room keeps for replay.
+const eventLogSize = 200
+
+// RoomJoin moves a client into the room of a class. A resuming client first
+// gets every logged event after lastSeq.
+type RoomJoin struct {
+	client  *Client
+	classId string
+	resume  bool
+	lastSeq uint64
+}
+
 type Hub struct {
 	sync.RWMutex
 	Clients    map[*Client]bool
+	rooms      map[string]map[*Client]bool
+	seq        map[string]uint64
+	log        map[string][]SequencedEvent
+	presence   map[string]map[string]*Presence
+	join       chan *RoomJoin
+	direct     chan *DirectMessage
 	register   chan *Client
 	unregister chan *Client
-	broadcast  chan *Message
-	db         *mongo.Client
+	// jtis or login families whose sockets must close
+	revoke    chan []string
+	broadcast chan *Message
+	db        *mongo.Client
 }
 
 func (h *Hub) Run() {
@@ -35,17 +74,146 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.Clients[client] = true
+			if client.classId != "" {
+				h.addToRoom(client, client.classId)
+			}
+		case j := <-h.join:
+			if !h.rooms[j.classId][j.client] {
+				h.leaveRooms(j.client)
+				h.addToRoom(j.client, j.classId)
+			}
+			if j.resume {
+				h.replay(j.client, j.classId, j.lastSeq)
+			}
+		case msg := <-h.direct:
+			users := map[string]bool{}
+			for _, v := range msg.UserIDs {
+				users[v] = true
+			}
+			for client := range h.rooms[msg.ClassID] {
+				if users[client.id] || (msg.Teachers && client.managesRoom()) {
+					client.send <- msg.Text
+				}
+			}
 		case client := <-h.unregister:
 			if _, ok := h.Clients[client]; ok {
+				h.leaveRooms(client)
 				close(client.send)
 				delete(h.Clients, client)
 			}
+		case ids := <-h.revoke:
+			revoked := map[string]bool{}
+			for _, v := range ids {
+				revoked[v] = true
+			}
+			for client := range h.Clients {
+				if revoked[client.jti] || revoked[client.sid] {
+					// the read pump fails on the closed conn and unregisters
+					go client.closeRevoked()
+				}
+			}
 		case msg := <-h.broadcast:
-			for client, connected := range h.Clients {
+			receivers := h.Clients
+			if msg.ClassID != "" {
+				receivers = h.rooms[msg.ClassID]
+			}
+			h.seq[msg.ClassID]++
+			event := SequencedEvent{
+				Seq:   h.seq[msg.ClassID],
+				Event: msg.Text,
+			}
+			if msg.ClassID != "" {
+				h.appendLog(msg.ClassID, event)
+			}
+			for client, connected := range receivers {
 				if connected {
-					client.send <- msg.Text
+					client.send <- event
 				}
 			}
 		}
 	}
 }
+
+func (h *Hub) addToRoom(client *Client, classId string) {
+	room, ok := h.rooms[classId]
+	if !ok {
+		room = make(map[*Client]bool)
+		h.rooms[classId] = room
+	}
+	room[client] = true
+	h.trackConnect(client, classId)
+}
+
+func (h *Hub) leaveRooms(client *Client) {
+	for classId, room := range h.rooms {
+		if _, ok := room[client]; ok {
+			delete(room, client)
+			h.trackDisconnect(client, classId)
+			if len(room) == 0 {
+				delete(h.rooms, classId)
+			}
+		}
+	}
+}
+
+func (h *Hub) appendLog(classId string, event SequencedEvent) {
+	log := append(h.log[classId], event)
+	if len(log) > eventLogSize {
+		log = log[len(log)-eventLogSize:]
+	}
+	h.log[classId] = log
+}
+
+// replay sends the events the client missed, then tells it whether the log
+// still covered everything since lastSeq.
+func (h *Hub) replay(client *Client, classId string, lastSeq uint64) {
+	log := h.log[classId]
+
+	if lastSeq > h.seq[classId] {
+		// the client saw a sequence from before a server restart
+		lastSeq = 0
+	}
+	complete := len(log) == 0 || log[0].Seq <= lastSeq+1
+
+	replayed := 0
+	for _, event := range log {
+		if event.Seq > lastSeq {
+			client.send <- event
+			replayed++
+		}
+	}
+
+	client.send <- WsResumed{
+		Event: "RESUMED",
+		Data: WsResumedData{
+			ClassID:  classId,
+			Seq:      h.seq[classId],
+			Replayed: replayed,
+			Complete: complete,
+		},
+	}
+}
+
+// sendToTeachers sends an event only to the teacher and admin sockets in the
+// class room, for events carrying other students' details.
+func (h *Hub) sendToTeachers(classId string, event WsEvent) {
+	h.direct <- &DirectMessage{
+		ClassID:  classId,
+		Teachers: true,
+		Text:     event,
+	}
+}
+
+// managesRoom reports whether the socket belongs to someone running the class
+// of its room. Teachers only get into the rooms of their own classes, so that
+// is every teacher and admin socket.
+func (c *Client) managesRoom() bool {
+	return c.role == "teacher" || c.role == "admin"
+}
+
+// closeRevoked closes a socket whose access token was revoked.
+func (c *Client) closeRevoked() {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked")
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.conn.Close()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"testing"
+)
+
+func newTestHub() *Hub {
+	return &Hub{
+		Clients:    make(map[*Client]bool),
+		rooms:      make(map[string]map[*Client]bool),
+		seq:        make(map[string]uint64),
+		log:        make(map[string][]SequencedEvent),
+		presence:   make(map[string]map[string]*Presence),
+		join:       make(chan *RoomJoin),
+		direct:     make(chan *DirectMessage),
+		broadcast:  make(chan *Message),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		revoke:     make(chan []string),
+	}
+}
+
+func TestHubSequencesPerRoom(t *testing.T) {
+	hub := newTestHub()
+	go hub.Run()
+
+	a := &Client{hub: hub, id: "a", role: "teacher", classId: "class a", send: make(chan WsEvent, 10)}
+	b := &Client{hub: hub, id: "b", role: "teacher", classId: "class b", send: make(chan WsEvent, 10)}
+	hub.register <- a
+	hub.register <- b
+
+	for _, classId := range []string{"class a", "class b", "class a"} {
+		hub.broadcast <- &Message{ClassID: classId, Type: "MARKED", Text: WsAck{Event: "MARKED"}}
+	}
+	// the hub handles one message at a time, so once this is taken the
+	// broadcasts are delivered
+	hub.register <- &Client{hub: hub, send: make(chan WsEvent)}
+
+	tests := []struct {
+		name   string
+		client *Client
+		want   []uint64
+	}{
+		{"room with two broadcasts", a, []uint64{1, 2}},
+		{"room with one broadcast", b, []uint64{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.client.send) != len(tt.want) {
+				t.Fatalf("%d events, want %d", len(tt.client.send), len(tt.want))
+			}
+			for _, want := range tt.want {
+				event := (<-tt.client.send).(SequencedEvent)
+				if event.Seq != want {
+					t.Fatalf("seq = %d, want %d", event.Seq, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	const classId = "class"
+	logged := func(seq uint64) *Hub {
+		hub := newTestHub()
+		for i := uint64(1); i <= seq; i++ {
+			hub.seq[classId] = i
+			hub.appendLog(classId, SequencedEvent{Seq: i})
+		}
+		return hub
+	}
+
+	tests := []struct {
+		name     string
+		seq      uint64
+		lastSeq  uint64
+		replayed int
+		complete bool
+	}{
+		{"missed a few", 10, 7, 3, true},
+		{"missed nothing", 10, 10, 0, true},
+		{"new client", 10, 0, 10, true},
+		{"missed more than the log keeps", eventLogSize + 50, 10, eventLogSize, false},
+		{"saw the log's first event", eventLogSize + 50, 50, eventLogSize, true},
+		// the client's sequence is from before a restart
+		{"ahead of the server", 5, 40, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := logged(tt.seq)
+			client := &Client{send: make(chan WsEvent, eventLogSize+1)}
+			hub.replay(client, classId, tt.lastSeq)
+
+			replayed := len(client.send) - 1
+			if replayed != tt.replayed {
+				t.Fatalf("%d events replayed, want %d", replayed, tt.replayed)
+			}
+			for i := 0; i < replayed; i++ {
+				<-client.send
+			}
+			resumed := (<-client.send).(WsResumed)
+			if resumed.Data.Seq != tt.seq || resumed.Data.Replayed != tt.replayed || resumed.Data.Complete != tt.complete {
+				t.Fatalf("RESUMED = %+v, want seq %d, replayed %d, complete %v", resumed.Data, tt.seq, tt.replayed, tt.complete)
+			}
+		})
+	}
+}
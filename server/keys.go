@@ -0,0 +1,288 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// environment variables the signing keys are configured with
+const (
+	// JWTKeysFileEnv names a JSON file listing the keys, see KeysConfig.
+	JWTKeysFileEnv = "JWT_KEYS_FILE"
+	// JWTSecretEnv is a single HS256 secret, for setups without a keys file.
+	JWTSecretEnv = "JWT_SECRET"
+	// JWTRandomSecretEnv set to true lets a development server start without
+	// keys, signing with a random secret that does not survive a restart.
+	JWTRandomSecretEnv = "JWT_RANDOM_SECRET"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// ErrNoKeys is returned when no signing keys are configured.
+var ErrNoKeys = fmt.Errorf("set %s or %s", JWTKeysFileEnv, JWTSecretEnv)
+
+// KeyConfig is one key in the keys file. Keys without a private key or
+// secret can only verify, which is how a retired key stays valid until the
+// tokens it signed run out.
+type KeyConfig struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	PublicKeyFile  string `json:"publicKeyFile,omitempty"`
+}
+
+// KeysConfig is the keys file. SigningKey is the kid new tokens are signed
+// with; every listed key is accepted when verifying.
+type KeysConfig struct {
+	SigningKey string      `json:"signingKey"`
+	Keys       []KeyConfig `json:"keys"`
+}
+
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// []byte for HS256, *rsa.PrivateKey or ed25519.PrivateKey otherwise
+	signKey any
+	// []byte for HS256, *rsa.PublicKey or ed25519.PublicKey otherwise
+	verifyKey any
+}
+
+// KeySet holds the keys tokens are signed and verified with.
+type KeySet struct {
+	signing *SigningKey
+	keys    map[string]*SigningKey
+}
+
+// signingKeys is loaded when the server starts.
+var signingKeys *KeySet
+
+// LoadKeySet reads the keys from the file in JWT_KEYS_FILE, or falls back
+// to the HS256 secret in JWT_SECRET. Without either it fails, unless
+// JWT_RANDOM_SECRET allows a random secret for development.
+func LoadKeySet() (*KeySet, error) {
+	if path := os.Getenv(JWTKeysFileEnv); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config := KeysConfig{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return NewKeySet(config)
+	}
+
+	secret := os.Getenv(JWTSecretEnv)
+	if secret == "" {
+		if os.Getenv(JWTRandomSecretEnv) != "true" {
+			return nil, ErrNoKeys
+		}
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return nil, fmt.Errorf("generating secret: %w", err)
+		}
+		secret = string(random)
+		util.PrintError(ErrNoKeys, JWTRandomSecretEnv+" is set, signing with a random secret")
+	}
+	return NewKeySet(KeysConfig{
+		SigningKey: "default",
+		Keys: []KeyConfig{
+			{ID: "default", Algorithm: jwt.SigningMethodHS256.Alg(), Secret: secret},
+		},
+	})
+}
+
+func NewKeySet(config KeysConfig) (*KeySet, error) {
+	set := &KeySet{keys: make(map[string]*SigningKey)}
+
+	for _, v := range config.Keys {
+		if v.ID == "" {
+			return nil, errors.New("key without kid")
+		}
+		if _, ok := set.keys[v.ID]; ok {
+			return nil, fmt.Errorf("duplicate kid %s", v.ID)
+		}
+		key, err := loadKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", v.ID, err)
+		}
+		set.keys[v.ID] = key
+	}
+
+	signing, ok := set.keys[config.SigningKey]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q not configured", config.SigningKey)
+	}
+	if signing.signKey == nil {
+		return nil, fmt.Errorf("signing key %s has no private key", signing.ID)
+	}
+	set.signing = signing
+
+	return set, nil
+}
+
+func loadKey(config KeyConfig) (*SigningKey, error) {
+	key := &SigningKey{ID: config.ID}
+
+	var private, public []byte
+	var err error
+	if config.PrivateKeyFile != "" {
+		if private, err = os.ReadFile(config.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.PublicKeyFile != "" {
+		if public, err = os.ReadFile(config.PublicKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.Algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		if config.Secret == "" {
+			return nil, errors.New("HS256 key without secret")
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.signKey = []byte(config.Secret)
+		key.verifyKey = []byte(config.Secret)
+
+	case jwt.SigningMethodRS256.Alg():
+		key.Method = jwt.SigningMethodRS256
+		if private != nil {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(private)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+		} else if public != nil {
+			if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(public); err != nil {
+				return nil, err
+			}
+		}
+
+	case jwt.SigningMethodEdDSA.Alg():
+		key.Method = jwt.SigningMethodEdDSA
+		if private != nil {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(private)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = privateKey.(ed25519.PrivateKey).Public()
+		} else if public != nil {
+			if key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(public); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", config.Algorithm)
+	}
+
+	if key.verifyKey == nil {
+		return nil, errors.New("no private or public key file")
+	}
+	return key, nil
+}
+
+// Sign signs the claims with the current signing key and names it in the
+// kid header.
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	token.Header["kid"] = k.signing.ID
+	return token.SignedString(k.signing.signKey)
+}
+
+// Parse verifies a token with the key named in its kid header. Tokens
+// without a kid are checked against the signing key.
+func (k *KeySet) Parse(raw string, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	return jwt.Parse(raw, k.keyFunc, opts...)
+}
+
+// ParseWithClaims is Parse decoding into the given claims.
+func (k *KeySet) ParseWithClaims(raw string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(raw, claims, k.keyFunc, opts...)
+}
+
+func (k *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	key := k.signing
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok = k.keys[kid]; !ok {
+			return nil, ErrUnknownKey
+		}
+	}
+	// the key decides the algorithm, so an RS256 public key can never be
+	// used as an HS256 secret
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return key.verifyKey, nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	KeyType string `json:"kty"`
+	ID      string `json:"kid"`
+	Alg     string `json:"alg"`
+	Use     string `json:"use"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+	Curve   string `json:"crv,omitempty"`
+	X       string `json:"x,omitempty"`
+}
+
+// JWKS lists the public keys. HS256 secrets are never published.
+func (k *KeySet) JWKS() []JWK {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	keys := []JWK{}
+	for _, key := range k.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				KeyType: "RSA",
+				ID:      key.ID,
+				Alg:     key.Method.Alg(),
+				Use:     "sig",
+				N:       encode(public.N.Bytes()),
+				E:       encode(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{
+				KeyType: "OKP",
+				ID:      key.ID,
+				Alg:     key.Method.Alg(),
+				Use:     "sig",
+				Curve:   "Ed25519",
+				X:       encode(public),
+			})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// handleJWKS publishes the public keys so other services can verify tokens.
+func handleJWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, gin.H{
+			"keys": signingKeys.JWKS(),
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes a key to a file in dir and returns its path.
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type testKeyFiles struct {
+	rsaPrivate, rsaPublic string
+	edPrivate, edPublic   string
+	rsaPublicPEM          []byte
+}
+
+func newTestKeyFiles(t *testing.T) testKeyFiles {
+	t.Helper()
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivate, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, err := x509.MarshalPKIXPublicKey(edPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := testKeyFiles{
+		rsaPrivate: writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		rsaPublic:  writePEM(t, dir, "rsa.pub", "PUBLIC KEY", rsaPublic),
+		edPrivate:  writePEM(t, dir, "ed.pem", "PRIVATE KEY", edPrivate),
+		edPublic:   writePEM(t, dir, "ed.pub", "PUBLIC KEY", edPublic),
+	}
+	files.rsaPublicPEM, err = os.ReadFile(files.rsaPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func testClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		ID:        "jti",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	files := newTestKeyFiles(t)
+
+	before, err := NewKeySet(KeysConfig{
+		SigningKey: "old",
+		Keys: []KeyConfig{
+			{ID: "old", Algorithm: "RS256", PrivateKeyFile: files.rsaPrivate},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := before.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old key is kept with only its public key while its tokens run out
+	during, err := NewKeySet(KeysConfig{
+		SigningKey: "new",
+		Keys: []KeyConfig{
+			{ID: "old", Algorithm: "RS256", PublicKeyFile: files.rsaPublic},
+			{ID: "new", Algorithm: "EdDSA", PrivateKeyFile: files.edPrivate},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := during.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := NewKeySet(KeysConfig{
+		SigningKey: "new",
+		Keys: []KeyConfig{
+			{ID: "new", Algorithm: "EdDSA", PrivateKeyFile: files.edPrivate},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		keys  *KeySet
+		token string
+		err   error
+	}{
+		{"old key before rotation", before, oldToken, nil},
+		{"old key kept for verifying", during, oldToken, nil},
+		{"new key", during, newToken, nil},
+		{"new key after old one retired", after, newToken, nil},
+		{"old key retired", after, oldToken, ErrUnknownKey},
+		{"new key unknown before rotation", before, newToken, ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.keys.Parse(tt.token)
+			if tt.err == nil && err != nil {
+				t.Fatalf("Parse() err = %v, want nil", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("Parse() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestKeySetPinsAlgorithm(t *testing.T) {
+	files := newTestKeyFiles(t)
+
+	keys, err := NewKeySet(KeysConfig{
+		SigningKey: "rsa",
+		Keys: []KeyConfig{
+			{ID: "rsa", Algorithm: "RS256", PrivateKeyFile: files.rsaPrivate},
+			{ID: "hmac", Algorithm: "HS256", Secret: "hmac secret"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, key any) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, testClaims())
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	own, err := keys.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"signed by the set", own, true},
+		{"hmac key with its secret", sign(jwt.SigningMethodHS256, "hmac", []byte("hmac secret")), true},
+		{"rsa public key used as hmac secret", sign(jwt.SigningMethodHS256, "rsa", files.rsaPublicPEM), false},
+		{"no kid, hmac with rsa public key", sign(jwt.SigningMethodHS256, "", files.rsaPublicPEM), false},
+		{"hmac key with a wrong secret", sign(jwt.SigningMethodHS256, "hmac", []byte("guess")), false},
+		{"alg none", sign(jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := keys.Parse(tt.token)
+			if tt.valid && err != nil {
+				t.Fatalf("Parse() err = %v, want valid", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("Parse() accepted the token")
+			}
+		})
+	}
+}
+
+func TestNewKeySetRejects(t *testing.T) {
+	files := newTestKeyFiles(t)
+
+	tests := []struct {
+		name   string
+		config KeysConfig
+	}{
+		{"no kid", KeysConfig{SigningKey: "", Keys: []KeyConfig{{Algorithm: "HS256", Secret: "s"}}}},
+		{"duplicate kid", KeysConfig{SigningKey: "a", Keys: []KeyConfig{{ID: "a", Algorithm: "HS256", Secret: "s"}, {ID: "a", Algorithm: "HS256", Secret: "t"}}}},
+		{"signing key missing", KeysConfig{SigningKey: "b", Keys: []KeyConfig{{ID: "a", Algorithm: "HS256", Secret: "s"}}}},
+		{"signing key without private key", KeysConfig{SigningKey: "a", Keys: []KeyConfig{{ID: "a", Algorithm: "RS256", PublicKeyFile: files.rsaPublic}}}},
+		{"hmac without secret", KeysConfig{SigningKey: "a", Keys: []KeyConfig{{ID: "a", Algorithm: "HS256"}}}},
+		{"unsupported algorithm", KeysConfig{SigningKey: "a", Keys: []KeyConfig{{ID: "a", Algorithm: "ES256", Secret: "s"}}}},
+		{"no key files", KeysConfig{SigningKey: "a", Keys: []KeyConfig{{ID: "a", Algorithm: "EdDSA"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeySet(tt.config); err == nil {
+				t.Fatal("NewKeySet() err = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		random string
+		err    error
+	}{
+		{"secret", "a secret", "", nil},
+		{"nothing set", "", "", ErrNoKeys},
+		{"random secret not allowed", "", "yes", ErrNoKeys},
+		{"random secret allowed", "", "true", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(JWTKeysFileEnv, "")
+			t.Setenv(JWTSecretEnv, tt.secret)
+			t.Setenv(JWTRandomSecretEnv, tt.random)
+
+			keys, err := LoadKeySet()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("LoadKeySet() err = %v, want %v", err, tt.err)
+			}
+			if err == nil {
+				if _, err := keys.Sign(testClaims()); err != nil {
+					t.Fatalf("Sign() err = %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/blob"
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// AttachmentDir is where the local blob store keeps leave attachments.
+	AttachmentDir     = "uploads"
+	maxAttachmentSize = 10 << 20
+
+	leaveDateLayout = "2006-01-02"
+)
+
+func leaveCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("leave_requests")
+}
+
+type LeaveRequestForm struct {
+	Reason    string `form:"reason" json:"reason" binding:"required"`
+	SessionID string `form:"sessionId" json:"sessionId"`
+	From      string `form:"from" json:"from"`
+	To        string `form:"to" json:"to"`
+}
+
+// leaveSessionFilter matches the sessions of the class a leave request
+// covers. Session ids carry their start time, so a date range maps to an id
+// range.
+func leaveSessionFilter(leave *data.LeaveRequest) bson.M {
+	filter := bson.M{"class_id": leave.ClassID}
+	if leave.SessionID != nil {
+		filter["_id"] = *leave.SessionID
+	} else {
+		filter["_id"] = bson.M{
+			"$gte": bson.NewObjectIDFromTimestamp(*leave.From),
+			"$lt":  bson.NewObjectIDFromTimestamp(leave.To.Add(24 * time.Hour)),
+		}
+	}
+	return filter
+}
+
+// leaveCovers reports whether the leave request applies to the session.
+func leaveCovers(leave *data.LeaveRequest, session *data.Session) bool {
+	if leave.SessionID != nil {
+		return *leave.SessionID == session.ID
+	}
+	started := session.ID.Timestamp()
+	return !started.Before(*leave.From) && started.Before(leave.To.Add(24*time.Hour))
+}
+
+// excusedStudents returns the students of the session with an approved leave
+// request covering it, so finalizing marks them excused instead of absent.
+func excusedStudents(ctx context.Context, db *mongo.Client, session *data.Session) (map[string]bool, error) {
+	filter := bson.M{
+		"class_id": session.ClassID,
+		"status":   data.LeaveApproved,
+	}
+	cur, err := leaveCollection(db).Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := []*data.LeaveRequest{}
+	if err := cur.All(ctx, &leaves); err != nil {
+		return nil, err
+	}
+
+	excused := map[string]bool{}
+	for _, v := range leaves {
+		if leaveCovers(v, session) {
+			excused[v.StudentID.Hex()] = true
+		}
+	}
+	return excused, nil
+}
+
+func submitLeaveRequest(db *mongo.Client, store blob.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := LeaveRequestForm{}
+		if err := c.ShouldBind(&ReqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+		studentId, _ := bson.ObjectIDFromHex(c.GetString("userId"))
+
+		leave := &data.LeaveRequest{
+			ID:        bson.NewObjectID(),
+			ClassID:   classId,
+			StudentID: studentId,
+			Reason:    ReqBody.Reason,
+			Status:    data.LeavePending,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		if ReqBody.SessionID != "" {
+			sessionId, err := bson.ObjectIDFromHex(ReqBody.SessionID)
+			if err == nil {
+				err = sessionsCollection(db).FindOne(c, bson.M{"_id": sessionId, "class_id": classId}).Err()
+			}
+			if err != nil {
+				c.JSON(404, gin.H{
+					"success": false,
+					"error":   "Session not found",
+				})
+				c.Abort()
+				util.PrintError(err, "leave session err")
+				return
+			}
+			leave.SessionID = &sessionId
+		} else {
+			from, err := time.Parse(leaveDateLayout, ReqBody.From)
+			to := from
+			if err == nil && ReqBody.To != "" {
+				to, err = time.Parse(leaveDateLayout, ReqBody.To)
+			}
+			if err != nil || to.Before(from) {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Give a sessionId or a from/to date range (YYYY-MM-DD)",
+				})
+				c.Abort()
+				return
+			}
+			leave.From = &from
+			leave.To = &to
+		}
+
+		file, err := c.FormFile("attachment")
+		if err == nil {
+			if file.Size > maxAttachmentSize {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Attachment too large",
+				})
+				c.Abort()
+				return
+			}
+
+			f, err := file.Open()
+			if err != nil {
+				util.InternalServerError(c, err, "attachment open err")
+				return
+			}
+			// the type the client claims is not trusted, it is read from
+			// the content instead
+			sniff := make([]byte, 512)
+			n, err := io.ReadFull(f, sniff)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			if err == nil {
+				_, err = f.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				f.Close()
+				util.InternalServerError(c, err, "attachment read err")
+				return
+			}
+			contentType := http.DetectContentType(sniff[:n])
+			key, err := store.Put(c, file.Filename, f)
+			f.Close()
+			if err != nil {
+				util.InternalServerError(c, err, "attachment store err")
+				return
+			}
+
+			leave.Attachment = &data.Attachment{
+				Key:         key,
+				FileName:    file.Filename,
+				ContentType: contentType,
+				Size:        file.Size,
+			}
+		} else if !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "attachment err")
+			return
+		}
+
+		if _, err := leaveCollection(db).InsertOne(c, leave); err != nil {
+			if leave.Attachment != nil {
+				store.Delete(c, leave.Attachment.Key)
+			}
+			util.InternalServerError(c, err, "leave request insertion err")
+			return
+		}
+
+		c.JSON(201, gin.H{
+			"success": true,
+			"data":    leave,
+		})
+	}
+}
+
+// getLeaveRequests lists the class's leave requests. Students only see their
+// own.
+func getLeaveRequests(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+		filter := bson.M{"class_id": classId}
+
+		if c.GetString("role") == "student" {
+			studentId, _ := bson.ObjectIDFromHex(c.GetString("userId"))
+			filter["student_id"] = studentId
+		}
+		if status, exists := c.GetQuery("status"); exists {
+			filter["status"] = status
+		}
+
+		cur, err := leaveCollection(db).Find(c, filter, options.Find().SetSort(bson.M{"_id": -1}))
+		if err != nil {
+			util.InternalServerError(c, err, "leave requests finding err")
+			return
+		}
+
+		leaves := []data.LeaveRequest{}
+		if err := cur.All(c, &leaves); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    leaves,
+		})
+	}
+}
+
+// findLeaveRequest loads the leave request named in the path and checks the
+// caller may see it.
+func findLeaveRequest(c *gin.Context, db *mongo.Client) (*data.LeaveRequest, bool) {
+	leaveId, err := bson.ObjectIDFromHex(c.Param("requestId"))
+	classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+	leave := &data.LeaveRequest{}
+	if err == nil {
+		err = leaveCollection(db).FindOne(c, bson.M{"_id": leaveId, "class_id": classId}).Decode(leave)
+	}
+	if err == nil && c.GetString("role") == "student" && leave.StudentID.Hex() != c.GetString("userId") {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		c.JSON(404, gin.H{
+			"success": false,
+			"error":   "Leave request not found",
+		})
+		c.Abort()
+		util.PrintError(err, "leave request finding err")
+		return nil, false
+	}
+	return leave, true
+}
+
+func getLeaveAttachment(db *mongo.Client, store blob.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		leave, ok := findLeaveRequest(c, db)
+		if !ok {
+			return
+		}
+
+		if leave.Attachment == nil {
+			c.JSON(404, gin.H{
+				"success": false,
+				"error":   "Attachment not found",
+			})
+			c.Abort()
+			return
+		}
+
+		r, err := store.Get(c, leave.Attachment.Key)
+		if err != nil {
+			c.JSON(404, gin.H{
+				"success": false,
+				"error":   "Attachment not found",
+			})
+			c.Abort()
+			util.PrintError(err, "attachment read err")
+			return
+		}
+		defer r.Close()
+
+		// always served as a download the browser must not render, whatever
+		// the stored type says
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": leave.Attachment.FileName})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		c.Header("Content-Disposition", disposition)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.DataFromReader(http.StatusOK, leave.Attachment.Size, "application/octet-stream", r, nil)
+	}
+}
+
+type LeaveReviewRequest struct {
+	Note string `json:"note"`
+}
+
+// reviewLeaveRequest approves or rejects a pending leave request. Approving
+// turns the student's absent records in the covered sessions into excused.
+// Approving an approved request again excuses any records a failed earlier
+// attempt left absent.
+func reviewLeaveRequest(db *mongo.Client, approve bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := LeaveReviewRequest{}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBind(&ReqBody); err != nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Invalid request schema",
+				})
+				c.Abort()
+				util.PrintError(err, "validation err")
+				return
+			}
+		}
+
+		leave, ok := findLeaveRequest(c, db)
+		if !ok {
+			return
+		}
+
+		if !approve || leave.Status != data.LeaveApproved {
+			if !setLeaveStatus(c, db, leave, approve, ReqBody.Note) {
+				return
+			}
+		}
+
+		if approve {
+			if err := excuseRecords(c, db, leave); err != nil {
+				util.InternalServerError(c, err, "excusing records err")
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    leave,
+		})
+	}
+}
+
+// setLeaveStatus records the review of a pending leave request, answering 409
+// when someone reviewed it first.
+func setLeaveStatus(c *gin.Context, db *mongo.Client, leave *data.LeaveRequest, approve bool, note string) bool {
+	status := data.LeaveRejected
+	if approve {
+		status = data.LeaveApproved
+	}
+	reviewer, _ := bson.ObjectIDFromHex(c.GetString("userId"))
+	now := time.Now().UTC()
+
+	update := bson.M{
+		"$set": bson.M{
+			"status":      status,
+			"reviewed_by": reviewer,
+			"reviewed_at": now,
+			"review_note": note,
+		},
+	}
+	err := leaveCollection(db).FindOneAndUpdate(c, bson.M{"_id": leave.ID, "status": data.LeavePending}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(leave)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(409, gin.H{
+			"success": false,
+			"error":   "Leave request already reviewed",
+		})
+		c.Abort()
+		return false
+	} else if err != nil {
+		util.InternalServerError(c, err, "leave request update err")
+		return false
+	}
+	return true
+}
+
+// excuseRecords marks the student excused in the finished sessions the leave
+// request covers. Each change goes into the record history.
+func excuseRecords(ctx context.Context, db *mongo.Client, leave *data.LeaveRequest) error {
+	filter := leaveSessionFilter(leave)
+	filter["state"] = data.SessionFinished
+
+	cur, err := sessionsCollection(db).Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+
+	sessions := []*data.Session{}
+	if err := cur.All(ctx, &sessions); err != nil {
+		return err
+	}
+
+	sessionIds := []bson.ObjectID{}
+	for _, v := range sessions {
+		sessionIds = append(sessionIds, v.ID)
+	}
+
+	recordFilter := bson.M{
+		"sessionid": bson.M{"$in": sessionIds},
+		"studentid": leave.StudentID,
+		"status":    data.StatusAbsent,
+	}
+	cur, err = recordsCollection(db).Find(ctx, recordFilter)
+	if err != nil {
+		return err
+	}
+
+	records := []*data.Attendance{}
+	if err := cur.All(ctx, &records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		_, err := changeRecordStatus(ctx, db, record, data.StatusExcused, "leave request approved", *leave.ReviewedBy)
+		if err != nil && !errors.Is(err, ErrRecordChanged) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestReviewLeaveRequest(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		status  string
+		approve bool
+		code    int
+		// whether the absent record ends up excused
+		excused bool
+	}{
+		{"approve pending", data.LeavePending, true, 200, true},
+		{"approve again after excusing failed", data.LeaveApproved, true, 200, true},
+		{"reject pending", data.LeavePending, false, 200, false},
+		{"reject approved", data.LeaveApproved, false, 409, false},
+		{"approve rejected", data.LeaveRejected, true, 409, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classId, studentId, teacherId := bson.NewObjectID(), bson.NewObjectID(), bson.NewObjectID()
+			session := &data.Session{
+				ID:      bson.NewObjectID(),
+				State:   data.SessionFinished,
+				ClassID: classId,
+			}
+			if err := saveSession(db, session); err != nil {
+				t.Fatal(err)
+			}
+			record := data.Attendance{
+				ID:        bson.NewObjectID(),
+				SessionID: session.ID,
+				ClassID:   classId,
+				StudentID: studentId,
+				Status:    data.StatusAbsent,
+				MarkedAt:  time.Now().UTC(),
+			}
+			if _, err := recordsCollection(db).InsertOne(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			leave := data.LeaveRequest{
+				ID:        bson.NewObjectID(),
+				ClassID:   classId,
+				StudentID: studentId,
+				SessionID: &session.ID,
+				Reason:    "ill",
+				Status:    tt.status,
+				CreatedAt: time.Now().UTC(),
+			}
+			if tt.status != data.LeavePending {
+				leave.ReviewedBy = &teacherId
+			}
+			if _, err := leaveCollection(db).InsertOne(ctx, leave); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				sessionsCollection(db).DeleteOne(ctx, bson.M{"_id": session.ID})
+				recordsCollection(db).DeleteOne(ctx, bson.M{"_id": record.ID})
+				recordHistoryCollection(db).DeleteMany(ctx, bson.M{"record_id": record.ID})
+				leaveCollection(db).DeleteOne(ctx, bson.M{"_id": leave.ID})
+			})
+
+			code, reply := runHandler(t, reviewLeaveRequest(db, tt.approve), testRequest{
+				method: http.MethodPost,
+				params: gin.Params{{Key: "requestId", Value: leave.ID.Hex()}},
+				values: map[string]any{"classId": classId.Hex(), "userId": teacherId.Hex(), "role": "teacher"},
+			})
+			if code != tt.code {
+				t.Fatalf("status = %d, want %d, reply %v", code, tt.code, reply)
+			}
+
+			stored := data.Attendance{}
+			if err := recordsCollection(db).FindOne(ctx, bson.M{"_id": record.ID}).Decode(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if excused := stored.Status == data.StatusExcused; excused != tt.excused {
+				t.Fatalf("record status = %s, want excused %v", stored.Status, tt.excused)
+			}
+		})
+	}
+}
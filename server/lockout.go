@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/ratelimit"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// environment variables the login limits are configured with
+const (
+	// LoginIPAttemptsEnv is how many failed logins an IP may have per
+	// window. A whole campus can sit behind one address, so it is generous
+	// and its lockouts do not grow.
+	LoginIPAttemptsEnv = "LOGIN_IP_ATTEMPTS"
+	LoginIPWindowEnv   = "LOGIN_IP_WINDOW"
+	LoginIPLockoutEnv  = "LOGIN_IP_LOCKOUT"
+	// LoginAccountAttemptsEnv is how many failed logins an account may have
+	// per window.
+	LoginAccountAttemptsEnv = "LOGIN_ACCOUNT_ATTEMPTS"
+	LoginAccountWindowEnv   = "LOGIN_ACCOUNT_WINDOW"
+	// LoginLockoutEnv is the first account lockout. Each one in a row
+	// doubles, up to LOGIN_MAX_LOCKOUT.
+	LoginLockoutEnv    = "LOGIN_LOCKOUT"
+	LoginMaxLockoutEnv = "LOGIN_MAX_LOCKOUT"
+)
+
+// lockoutCheckInterval is how often lockouts that ran out are recorded.
+const lockoutCheckInterval = 30 * time.Second
+
+// lockout scopes
+const (
+	LockoutIP          = "ip"
+	LockoutAccount     = "account"
+	LockoutMailIP      = "mail_ip"
+	LockoutMailAccount = "mail_account"
+)
+
+// reasons a lockout is cleared
+const (
+	UnlockedByExpiry        = "expired"
+	UnlockedByLogin         = "login"
+	UnlockedByPasswordReset = "password_reset"
+	UnlockedByAdmin         = "admin"
+)
+
+// LoginLimits throttles logins per client IP and per account. Requests that
+// mail a link to an account, such as forgot password, are throttled the same
+// way with their own counts.
+type LoginLimits struct {
+	IP          ratelimit.Limiter
+	Account     ratelimit.Limiter
+	MailIP      ratelimit.Limiter
+	MailAccount ratelimit.Limiter
+}
+
+// NewLoginLimits keeps the limits in memory, configured from the
+// environment.
+func NewLoginLimits() (*LoginLimits, error) {
+	lockout, err := envDuration(LoginLockoutEnv, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	maxLockout, err := envDuration(LoginMaxLockoutEnv, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if maxLockout < lockout {
+		return nil, fmt.Errorf("%s is shorter than %s", LoginMaxLockoutEnv, LoginLockoutEnv)
+	}
+
+	ipAttempts, err := envInt(LoginIPAttemptsEnv, 100)
+	if err != nil {
+		return nil, err
+	}
+	ipWindow, err := envDuration(LoginIPWindowEnv, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	ipLockout, err := envDuration(LoginIPLockoutEnv, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	accountAttempts, err := envInt(LoginAccountAttemptsEnv, 5)
+	if err != nil {
+		return nil, err
+	}
+	accountWindow, err := envDuration(LoginAccountWindowEnv, 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	ipPolicy := ratelimit.Policy{
+		Attempts:   ipAttempts,
+		Window:     ipWindow,
+		Lockout:    ipLockout,
+		MaxLockout: ipLockout,
+	}
+	accountPolicy := ratelimit.Policy{
+		Attempts:   accountAttempts,
+		Window:     accountWindow,
+		Lockout:    lockout,
+		MaxLockout: maxLockout,
+	}
+	return &LoginLimits{
+		IP:          ratelimit.NewMemory(ipPolicy),
+		Account:     ratelimit.NewMemory(accountPolicy),
+		MailIP:      ratelimit.NewMemory(ipPolicy),
+		MailAccount: ratelimit.NewMemory(accountPolicy),
+	}, nil
+}
+
+func envInt(name string, fallback int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return n, nil
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 90s or 15m", name)
+	}
+	return d, nil
+}
+
+// accountKey ignores case, so changing it does not buy more attempts.
+func accountKey(email string) string {
+	return strings.ToLower(email)
+}
+
+func lockoutEventsCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("lockout_events")
+}
+
+// recordLockout saves a lockout starting. Failing to save it does not stop
+// the lockout.
+func recordLockout(db *mongo.Client, scope string, key string, lockout time.Duration) {
+	now := time.Now().UTC()
+	until := now.Add(lockout)
+	_, err := lockoutEventsCollection(db).InsertOne(context.Background(), data.LockoutEvent{
+		ID:        bson.NewObjectID(),
+		Event:     data.LockoutStarted,
+		Scope:     scope,
+		Key:       key,
+		Until:     &until,
+		CreatedAt: now,
+	})
+	if err != nil {
+		util.PrintError(err, "recording lockout err")
+	}
+}
+
+// recordUnlock saves a lockout ending.
+func recordUnlock(ctx context.Context, db *mongo.Client, scope string, key string, reason string, changedBy *bson.ObjectID) error {
+	_, err := lockoutEventsCollection(db).InsertOne(ctx, data.LockoutEvent{
+		ID:        bson.NewObjectID(),
+		Event:     data.LockoutCleared,
+		Scope:     scope,
+		Key:       key,
+		Reason:    reason,
+		ChangedBy: changedBy,
+		CreatedAt: time.Now().UTC(),
+	})
+	return err
+}
+
+// clearAccountLockout forgets the account's failed logins and records the
+// unlock if that ended a lockout.
+func clearAccountLockout(ctx context.Context, db *mongo.Client, limits *LoginLimits, email string, reason string, changedBy *bson.ObjectID) error {
+	key := accountKey(email)
+	ended, err := limits.Account.Reset(ctx, key)
+	if err != nil || !ended {
+		return err
+	}
+	return recordUnlock(ctx, db, LockoutAccount, key, reason, changedBy)
+}
+
+// watchLockouts records the lockouts that ran out on their own.
+func watchLockouts(db *mongo.Client, limits *LoginLimits) {
+	ticker := time.NewTicker(lockoutCheckInterval)
+	defer ticker.Stop()
+
+	scopes := map[string]ratelimit.Limiter{
+		LockoutIP:          limits.IP,
+		LockoutAccount:     limits.Account,
+		LockoutMailIP:      limits.MailIP,
+		LockoutMailAccount: limits.MailAccount,
+	}
+	for range ticker.C {
+		for scope, limiter := range scopes {
+			keys, err := limiter.Expired(context.Background())
+			if err != nil {
+				util.PrintError(err, "listing expired lockouts err")
+				continue
+			}
+			for _, key := range keys {
+				if err := recordUnlock(context.Background(), db, scope, key, UnlockedByExpiry, nil); err != nil {
+					util.PrintError(err, "recording unlock err")
+				}
+			}
+		}
+	}
+}
+
+// tooManyAttempts refuses a request, telling the client when to try again.
+func tooManyAttempts(c *gin.Context, wait time.Duration, msg string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"success": false,
+		"error":   msg,
+	})
+	c.Abort()
+}
+
+// checkLoginLimits refuses the attempt when the client IP or the account is
+// locked out.
+func checkLoginLimits(c *gin.Context, limits *LoginLimits, email string) bool {
+	wait, err := limits.IP.Check(c, c.ClientIP())
+	if err == nil && wait == 0 {
+		wait, err = limits.Account.Check(c, accountKey(email))
+	}
+	if err != nil {
+		util.InternalServerError(c, err, "checking login limits err")
+		return false
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait, "Too many login attempts, try again later")
+		return false
+	}
+	return true
+}
+
+// loginFailed counts a failed login against the client IP and the account,
+// and refuses it with Retry-After when that locks either. Unknown emails are
+// counted too, so lockouts do not reveal which accounts exist.
+func loginFailed(c *gin.Context, db *mongo.Client, limits *LoginLimits, email string) {
+	ip, key := c.ClientIP(), accountKey(email)
+
+	ipLockout, err := limits.IP.Hit(c, ip)
+	if err != nil {
+		util.PrintError(err, "counting failed login err")
+	} else if ipLockout > 0 {
+		recordLockout(db, LockoutIP, ip, ipLockout)
+	}
+	accountLockout, err := limits.Account.Hit(c, key)
+	if err != nil {
+		util.PrintError(err, "counting failed login err")
+	} else if accountLockout > 0 {
+		recordLockout(db, LockoutAccount, key, accountLockout)
+	}
+
+	if lockout := max(ipLockout, accountLockout); lockout > 0 {
+		tooManyAttempts(c, lockout, "Too many login attempts, try again later")
+		return
+	}
+
+	c.JSON(400, gin.H{
+		"success": false,
+		"error":   "Invalid email or password",
+	})
+	c.Abort()
+}
+
+// mailRequested counts a request that mails the account a link against the
+// client IP and the account, and refuses it once either is locked out. Every
+// request counts, whether or not the account exists, so the limit neither
+// reveals accounts nor lets anyone flood an inbox.
+func mailRequested(c *gin.Context, db *mongo.Client, limits *LoginLimits, email string) bool {
+	ip, key := c.ClientIP(), accountKey(email)
+
+	wait, err := limits.MailIP.Check(c, ip)
+	if err == nil && wait == 0 {
+		wait, err = limits.MailAccount.Check(c, key)
+	}
+	if err != nil {
+		util.InternalServerError(c, err, "checking mail limits err")
+		return false
+	}
+	if wait > 0 {
+		tooManyAttempts(c, wait, "Too many requests, try again later")
+		return false
+	}
+
+	if lockout, err := limits.MailIP.Hit(c, ip); err != nil {
+		util.PrintError(err, "counting mail request err")
+	} else if lockout > 0 {
+		recordLockout(db, LockoutMailIP, ip, lockout)
+	}
+	if lockout, err := limits.MailAccount.Hit(c, key); err != nil {
+		util.PrintError(err, "counting mail request err")
+	} else if lockout > 0 {
+		recordLockout(db, LockoutMailAccount, key, lockout)
+	}
+	return true
+}
+
+// unlockUser clears a lockout on the user's account before it runs out.
+func unlockUser(db *mongo.Client, limits *LoginLimits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := findUser(c, db)
+		if !ok {
+			return
+		}
+
+		adminId, err := bson.ObjectIDFromHex(c.GetString("userId"))
+		if err != nil {
+			util.InternalServerError(c, err, "object id err")
+			return
+		}
+		if err := clearAccountLockout(c, db, limits, user.Email, UnlockedByAdmin, &adminId); err != nil {
+			util.InternalServerError(c, err, "clearing lockout err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    userResponse(*user),
+		})
+	}
+}
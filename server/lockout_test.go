@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewLoginLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// lockouts the account gets locking it out again and again, empty
+		// when the configuration is refused
+		lockouts []time.Duration
+	}{
+		{"defaults", nil, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}},
+		{"configured", map[string]string{
+			LoginAccountAttemptsEnv: "2",
+			LoginLockoutEnv:         "30s",
+			LoginMaxLockoutEnv:      "1m",
+		}, []time.Duration{30 * time.Second, time.Minute, time.Minute}},
+		{"max shorter than first lockout", map[string]string{LoginLockoutEnv: "1h", LoginMaxLockoutEnv: "1m"}, nil},
+		{"attempts not a number", map[string]string{LoginAccountAttemptsEnv: "five"}, nil},
+		{"attempts zero", map[string]string{LoginIPAttemptsEnv: "0"}, nil},
+		{"duration without unit", map[string]string{LoginAccountWindowEnv: "15"}, nil},
+		{"negative duration", map[string]string{LoginIPLockoutEnv: "-5m"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{LoginIPAttemptsEnv, LoginIPWindowEnv, LoginIPLockoutEnv, LoginAccountAttemptsEnv, LoginAccountWindowEnv, LoginLockoutEnv, LoginMaxLockoutEnv} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			limits, err := NewLoginLimits()
+			if len(tt.lockouts) == 0 {
+				if err == nil {
+					t.Fatal("NewLoginLimits() err = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewLoginLimits() err = %v", err)
+			}
+
+			// each lockout is hit straight after the last one, so they
+			// escalate
+			for i, want := range tt.lockouts {
+				var lockout time.Duration
+				for lockout == 0 {
+					if lockout, err = limits.Account.Hit(context.Background(), "user@example.com"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if lockout != want {
+					t.Fatalf("lockout %d = %v, want %v", i+1, lockout, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAccountKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"user@example.com", "USER@example.com"},
+		{"user@example.com", "User@Example.Com"},
+	}
+	for _, tt := range tests {
+		if accountKey(tt.a) != accountKey(tt.b) {
+			t.Errorf("accountKey(%q) != accountKey(%q)", tt.a, tt.b)
+		}
+	}
+}
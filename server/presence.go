@@ -0,0 +1,178 @@
+package server
+
+import (
+	"time"
+)
+
+// Presence is whether a student has a socket open in the class room. A
+// student with several sockets stays online until the last one closes.
+type Presence struct {
+	StudentID      string     `json:"studentID"`
+	Online         bool       `json:"online"`
+	ConnectedAt    time.Time  `json:"connectedAt"`
+	DisconnectedAt *time.Time `json:"disconnectedAt,omitempty"`
+
+	connections int
+	// time spent online since counting started, excluding the current
+	// connection
+	onlineFor   time.Duration
+	onlineSince time.Time
+}
+
+// onlineDuration is how long the student has been online since counting
+// started.
+func (p *Presence) onlineDuration(now time.Time) time.Duration {
+	d := p.onlineFor
+	if p.Online {
+		d += now.Sub(p.onlineSince)
+	}
+	return d
+}
+
+type WsPresenceData struct {
+	ClassID  string     `json:"classId"`
+	Students []Presence `json:"students"`
+}
+
+type WsPresence struct {
+	Event string         `json:"event"`
+	Data  WsPresenceData `json:"data"`
+}
+
+func (w WsPresence) EventName() string { return w.Event }
+
+// trackConnect and trackDisconnect run on the hub goroutine whenever a
+// student socket enters or leaves a class room.
+func (h *Hub) trackConnect(client *Client, classId string) {
+	if client.role != "student" {
+		return
+	}
+
+	h.Lock()
+	room, ok := h.presence[classId]
+	if !ok {
+		room = make(map[string]*Presence)
+		h.presence[classId] = room
+	}
+	p, ok := room[client.id]
+	if !ok {
+		p = &Presence{StudentID: client.id}
+		room[client.id] = p
+	}
+	p.connections++
+	changed := !p.Online
+	if changed {
+		now := time.Now().UTC()
+		p.Online = true
+		p.ConnectedAt = now
+		p.onlineSince = now
+	}
+	snapshot := *p
+	h.Unlock()
+
+	if changed {
+		h.notifyTeachers(classId, snapshot)
+	}
+}
+
+func (h *Hub) trackDisconnect(client *Client, classId string) {
+	if client.role != "student" {
+		return
+	}
+
+	h.Lock()
+	p, ok := h.presence[classId][client.id]
+	if !ok || p.connections == 0 {
+		h.Unlock()
+		return
+	}
+	p.connections--
+	changed := p.connections == 0
+	if changed {
+		now := time.Now().UTC()
+		p.onlineFor += now.Sub(p.onlineSince)
+		p.Online = false
+		p.DisconnectedAt = &now
+	}
+	snapshot := *p
+	h.Unlock()
+
+	if changed {
+		h.notifyTeachers(classId, snapshot)
+	}
+}
+
+// notifyTeachers sends a PRESENCE change to the teacher and admin sockets in
+// the room.
+// It must run on the hub goroutine.
+func (h *Hub) notifyTeachers(classId string, p Presence) {
+	event := WsPresence{
+		Event: "PRESENCE",
+		Data: WsPresenceData{
+			ClassID:  classId,
+			Students: []Presence{p},
+		},
+	}
+	for client := range h.rooms[classId] {
+		if client.managesRoom() {
+			client.send <- event
+		}
+	}
+}
+
+// Presence returns the presence of every student seen in the class room.
+func (h *Hub) Presence(classId string) []Presence {
+	h.RLock()
+	defer h.RUnlock()
+
+	students := []Presence{}
+	for _, p := range h.presence[classId] {
+		students = append(students, *p)
+	}
+	return students
+}
+
+// resetPresence starts counting online time afresh, when a session starts.
+func (h *Hub) resetPresence(classId string, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, p := range h.presence[classId] {
+		p.onlineFor = 0
+		p.onlineSince = now
+	}
+}
+
+// OnlineDurations returns how long each student has been online since the
+// last reset.
+func (h *Hub) OnlineDurations(classId string, now time.Time) map[string]time.Duration {
+	h.RLock()
+	defer h.RUnlock()
+
+	durations := map[string]time.Duration{}
+	for studentId, p := range h.presence[classId] {
+		durations[studentId] = p.onlineDuration(now)
+	}
+	return durations
+}
+
+// wsPresence handles the PRESENCE event, answering with the whole room.
+func (c *Client) wsPresence(req WsReq) {
+	if !c.managesRoom() {
+		c.sendError(req.RequestID, "Forbidden, teacher event only")
+		return
+	}
+	if c.classId == "" {
+		c.sendError(req.RequestID, "Join a class first")
+		return
+	}
+
+	c.send <- WsPresence{
+		Event: "PRESENCE",
+		Data: WsPresenceData{
+			ClassID:  c.classId,
+			Students: c.hub.Presence(c.classId),
+		},
+	}
+	c.ack(req)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// reasons a check-in is flagged
+const (
+	SameDeviceID       = "same device id"
+	SameIPAndUserAgent = "same ip and user agent"
+)
+
+func requestDevice(c *gin.Context, deviceId string) data.Device {
+	return data.Device{
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		DeviceID:  deviceId,
+	}
+}
+
+// detectSharedDevice compares the attempt's device with the self check-ins
+// already in the session. An IP alone is not enough, since a whole campus can
+// sit behind one address. The caller must hold the session lock.
+func detectSharedDevice(session *data.Session, attempt CheckInAttempt) *data.CheckInFlag {
+	others := []string{}
+	reasons := map[string]bool{}
+
+	for studentId, mark := range session.AttendanceStatus {
+		if studentId == attempt.StudentID || mark.Device == nil {
+			continue
+		}
+
+		shared := false
+		if attempt.Device.DeviceID != "" && mark.Device.DeviceID == attempt.Device.DeviceID {
+			reasons[SameDeviceID] = true
+			shared = true
+		}
+		if attempt.Device.IP != "" && mark.Device.IP == attempt.Device.IP && mark.Device.UserAgent == attempt.Device.UserAgent {
+			reasons[SameIPAndUserAgent] = true
+			shared = true
+		}
+		if shared {
+			others = append(others, studentId)
+		}
+	}
+
+	if len(others) == 0 {
+		return nil
+	}
+
+	flag := &data.CheckInFlag{
+		ID:              bson.NewObjectID(),
+		SessionID:       session.ID,
+		ClassID:         session.ClassID,
+		StudentID:       attempt.StudentID,
+		OtherStudentIDs: others,
+		Device:          attempt.Device,
+		CreatedAt:       time.Now().UTC(),
+	}
+	for reason := range reasons {
+		flag.Reasons = append(flag.Reasons, reason)
+	}
+	return flag
+}
+
+func flagsCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("checkin_flags")
+}
+
+type WsSuspiciousCheckIn struct {
+	Event string           `json:"event"`
+	Data  data.CheckInFlag `json:"data"`
+}
+
+func (w WsSuspiciousCheckIn) EventName() string { return w.Event }
+
+// reportSuspiciousCheckIn stores the flag for review and sends it to the
+// teacher. It holds the students' IPs and devices, so the room never sees it.
+func reportSuspiciousCheckIn(db *mongo.Client, hub *Hub, flag *data.CheckInFlag) {
+	if _, err := flagsCollection(db).InsertOne(context.Background(), flag); err != nil {
+		util.PrintError(err, "check-in flag insertion err")
+	}
+
+	hub.sendToTeachers(flag.ClassID.Hex(), WsSuspiciousCheckIn{
+		Event: "SUSPICIOUS_CHECKIN",
+		Data:  *flag,
+	})
+}
+
+// getSuspiciousCheckIns lists the flagged check-ins of a class, optionally
+// for one session.
+func getSuspiciousCheckIns(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+		filter := bson.M{"class_id": classId}
+
+		if raw, exists := c.GetQuery("sessionId"); exists {
+			sessionId, err := bson.ObjectIDFromHex(raw)
+			if err != nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Invalid request schema",
+				})
+				c.Abort()
+				util.PrintError(err, "object id err")
+				return
+			}
+			filter["session_id"] = sessionId
+		}
+
+		cur, err := flagsCollection(db).Find(c, filter, options.Find().SetSort(bson.M{"_id": -1}))
+		if err != nil {
+			util.InternalServerError(c, err, "check-in flags finding err")
+			return
+		}
+
+		flags := []data.CheckInFlag{}
+		if err := cur.All(c, &flags); err != nil {
+			util.InternalServerError(c, err, "cursor iteration err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    flags,
+		})
+	}
+}
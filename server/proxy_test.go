@@ -0,0 +1,64 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestDetectSharedDevice(t *testing.T) {
+	phone := data.Device{IP: "10.0.0.1", UserAgent: "phone", DeviceID: "device-1"}
+	laptop := data.Device{IP: "10.0.0.1", UserAgent: "laptop", DeviceID: "device-2"}
+	student, first, second, teacherMarked := "student", "first", "second", "teacher marked"
+
+	session := &data.Session{
+		ID:      bson.NewObjectID(),
+		ClassID: bson.NewObjectID(),
+		AttendanceStatus: data.AttendanceStatus{
+			first:         {Status: data.StatusPresent, Device: &phone},
+			second:        {Status: data.StatusPresent, Device: &laptop},
+			teacherMarked: {Status: data.StatusPresent},
+			// the student's own earlier check-in never counts against them
+			student: {Status: data.StatusPresent, Device: &phone},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		device  data.Device
+		others  []string
+		reasons []string
+	}{
+		{"own device", data.Device{IP: "10.0.0.2", UserAgent: "tablet", DeviceID: "device-3"}, nil, nil},
+		{"same ip, other browser", data.Device{IP: "10.0.0.1", UserAgent: "tablet"}, nil, nil},
+		{"same device id from another network", data.Device{IP: "10.0.0.9", UserAgent: "phone", DeviceID: "device-1"}, []string{first}, []string{SameDeviceID}},
+		{"same ip and user agent without a device id", data.Device{IP: "10.0.0.1", UserAgent: "laptop"}, []string{second}, []string{SameIPAndUserAgent}},
+		{"same device", phone, []string{first}, []string{SameDeviceID, SameIPAndUserAgent}},
+		{"device id of one, browser of another", data.Device{IP: "10.0.0.1", UserAgent: "laptop", DeviceID: "device-1"}, []string{first, second}, []string{SameDeviceID, SameIPAndUserAgent}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag := detectSharedDevice(session, CheckInAttempt{StudentID: student, Device: tt.device})
+			if tt.others == nil {
+				if flag != nil {
+					t.Fatalf("flagged with %v, want no flag", flag.OtherStudentIDs)
+				}
+				return
+			}
+			if flag == nil {
+				t.Fatal("not flagged")
+			}
+
+			slices.Sort(flag.OtherStudentIDs)
+			slices.Sort(flag.Reasons)
+			if !slices.Equal(flag.OtherStudentIDs, tt.others) || !slices.Equal(flag.Reasons, tt.reasons) {
+				t.Fatalf("flag = %v %v, want %v %v", flag.OtherStudentIDs, flag.Reasons, tt.others, tt.reasons)
+			}
+			if flag.StudentID != student || flag.SessionID != session.ID || flag.Device != tt.device {
+				t.Fatalf("flag = %+v, want it for %s in session %s", flag, student, session.ID.Hex())
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	DefaultQRRefreshInterval = 15 * time.Second
+	minQRRefreshInterval     = 5 * time.Second
+	maxQRRefreshInterval     = 5 * time.Minute
+
+	qrImageSize = 512
+)
+
+var ErrInvalidQRToken = errors.New("invalid or expired check-in token")
+
+// newQRToken signs a check-in token for the session that expires after one
+// refresh interval.
+func newQRToken(session *data.Session, lifetime time.Duration) (string, error) {
+	return signingKeys.Sign(jwt.MapClaims{
+		"purpose":   "checkin",
+		"classId":   session.ClassID.Hex(),
+		"sessionId": session.ID.Hex(),
+		"exp":       time.Now().Add(lifetime).Unix(),
+	})
+}
+
+// parseQRToken checks the signature and expiry and returns the class and
+// session ids the token was issued for.
+func parseQRToken(raw string) (string, string, error) {
+	token, err := signingKeys.Parse(raw, jwt.WithExpirationRequired())
+	if err != nil {
+		return "", "", ErrInvalidQRToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != "checkin" {
+		return "", "", ErrInvalidQRToken
+	}
+	classId, _ := claims["classId"].(string)
+	sessionId, _ := claims["sessionId"].(string)
+	if classId == "" || sessionId == "" {
+		return "", "", ErrInvalidQRToken
+	}
+	return classId, sessionId, nil
+}
+
+// qrRefreshInterval reads the optional interval query parameter in seconds.
+func qrRefreshInterval(c *gin.Context) (time.Duration, bool) {
+	raw, exists := c.GetQuery("interval")
+	if !exists {
+		return DefaultQRRefreshInterval, true
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, false
+	}
+	interval := time.Duration(seconds) * time.Second
+	if interval < minQRRefreshInterval || interval > maxQRRefreshInterval {
+		return 0, false
+	}
+	return interval, true
+}
+
+// getCheckInQR returns a PNG QR code for checking in to the running session.
+// It encodes a link to the client app's /check-in page, which posts the token
+// with the student's credentials. Without APP_BASE_URL it encodes the bare
+// token for an app that posts it itself. The page showing it should reload it
+// every interval.
+func getCheckInQR(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		interval, ok := qrRefreshInterval(c)
+		if !ok {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid refresh interval",
+			})
+			c.Abort()
+			return
+		}
+
+		session, ok := ActiveSessions.Get(c.GetString("classId"))
+		if !ok {
+			c.JSON(404, gin.H{
+				"success": false,
+				"error":   "No active attendance session",
+			})
+			c.Abort()
+			return
+		}
+
+		session.Lock()
+		token, err := newQRToken(session, interval)
+		session.Unlock()
+		if err != nil {
+			util.InternalServerError(c, err, "signing qr token err")
+			return
+		}
+
+		content := appLink("/check-in", token)
+		if content == "" {
+			content = token
+		}
+		png, err := qrcode.Encode(content, qrcode.Medium, qrImageSize)
+		if err != nil {
+			util.InternalServerError(c, err, "qr encoding err")
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "image/png", png)
+	}
+}
+
+type QRCheckInRequest struct {
+	Token    string            `json:"token"`
+	Location *data.Coordinates `json:"location"`
+	DeviceID string            `json:"deviceId"`
+}
+
+// handleQRCheckIn checks a student in with the token from a scanned QR code.
+// The token may come in the body or in the query string.
+func handleQRCheckIn(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := QRCheckInRequest{}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Invalid request schema",
+				})
+				c.Abort()
+				util.PrintError(err, "req bind err")
+				return
+			}
+		}
+		if req.Token == "" {
+			req.Token = c.Query("token")
+		}
+		if req.Token == "" {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			return
+		}
+
+		classId, sessionId, err := parseQRToken(req.Token)
+		if err != nil {
+			c.JSON(401, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
+		studentId := c.GetString("userId")
+		class, code, msg := authorizeClass(c, db, classId, studentId, c.GetString("role"))
+		if class == nil {
+			c.JSON(code, gin.H{
+				"success": false,
+				"error":   msg,
+			})
+			c.Abort()
+			return
+		}
+
+		session, ok := ActiveSessions.Get(classId)
+		if !ok || session.ID.Hex() != sessionId {
+			c.JSON(404, gin.H{
+				"success": false,
+				"error":   "No active attendance session",
+			})
+			c.Abort()
+			return
+		}
+
+		mark, flag, err := checkIn(db, session, CheckInAttempt{
+			StudentID: studentId,
+			Method:    CheckInByQR,
+			Location:  req.Location,
+			Device:    requestDevice(c, req.DeviceID),
+		})
+		if err != nil {
+			checkInFailed(hub, studentId, session, err)
+			c.JSON(checkInErrorStatus(err), gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
+		checkInSucceeded(db, hub, studentId, session, mark, flag)
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"classId": classId,
+				"mark":    mark,
+			},
+		})
+	}
+}
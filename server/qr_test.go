@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestParseQRToken(t *testing.T) {
+	useTestKeys(t, "qr secret")
+	session := &data.Session{ID: bson.NewObjectID(), ClassID: bson.NewObjectID()}
+
+	token := func(lifetime time.Duration) string {
+		raw, err := newQRToken(session, lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	accessToken, err := signingKeys.Sign(MyClaims{
+		UserId: bson.NewObjectID().Hex(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewKeySet(KeysConfig{
+		SigningKey: "other",
+		Keys:       []KeyConfig{{ID: "other", Algorithm: "HS256", Secret: "another secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := other.Sign(jwt.MapClaims{
+		"purpose":   "checkin",
+		"classId":   session.ClassID.Hex(),
+		"sessionId": session.ID.Hex(),
+		"exp":       time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		raw   string
+		valid bool
+	}{
+		{"fresh", token(time.Minute), true},
+		{"expired", token(-time.Second), false},
+		{"access token", accessToken, false},
+		{"signed with another key", otherToken, false},
+		{"garbage", "not a token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classId, sessionId, err := parseQRToken(tt.raw)
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidQRToken) {
+					t.Fatalf("parseQRToken() err = %v, want %v", err, ErrInvalidQRToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if classId != session.ClassID.Hex() || sessionId != session.ID.Hex() {
+				t.Fatalf("parseQRToken() = %s, %s, want %s, %s", classId, sessionId, session.ClassID.Hex(), session.ID.Hex())
+			}
+		})
+	}
+}
+
+func TestQRRefreshInterval(t *testing.T) {
+	tests := []struct {
+		query string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", DefaultQRRefreshInterval, true},
+		{"?interval=5", 5 * time.Second, true},
+		{"?interval=300", 5 * time.Minute, true},
+		{"?interval=4", 0, false},
+		{"?interval=301", 0, false},
+		{"?interval=ten", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/"+tt.query, nil)
+
+			got, ok := qrRefreshInterval(c)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("qrRefreshInterval() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	DefaultRollCallTimeout = 30 * time.Second
+	maxRollCallTimeout     = 5 * time.Minute
+
+	// MissedRollCall is the flag reason for a student who did not answer.
+	MissedRollCall = "missed roll call"
+	// RollCallMissed is the method of a mark downgraded by a roll call.
+	RollCallMissed = "roll_call"
+)
+
+// RollCall is a spot check of some of the students marked present. Each
+// picked student must answer before the deadline.
+type RollCall struct {
+	ID        string
+	SessionID bson.ObjectID
+	ClassID   bson.ObjectID
+	Deadline  time.Time
+	// picked student id -> answered
+	students map[string]bool
+	// picked student id -> their mark when picked, so a mark the teacher
+	// changed since is not downgraded
+	marks data.AttendanceStatus
+}
+
+type RollCallRegistry struct {
+	sync.Mutex
+	list map[string]*RollCall
+}
+
+var ActiveRollCalls = &RollCallRegistry{list: make(map[string]*RollCall)}
+
+func (r *RollCallRegistry) Add(rollCall *RollCall) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.list[rollCall.ID] = rollCall
+}
+
+// Answer records a student's answer. It fails if the roll call is over or
+// the student was not picked.
+func (r *RollCallRegistry) Answer(id string, studentId string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	rollCall, ok := r.list[id]
+	if !ok || time.Now().After(rollCall.Deadline) {
+		return false
+	}
+	if _, picked := rollCall.students[studentId]; !picked {
+		return false
+	}
+	rollCall.students[studentId] = true
+	return true
+}
+
+// Close removes the roll call and returns who answered and who did not.
+func (r *RollCallRegistry) Close(id string) (answered []string, missed []string) {
+	r.Lock()
+	defer r.Unlock()
+
+	rollCall, ok := r.list[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(r.list, id)
+
+	answered, missed = []string{}, []string{}
+	for studentId, ok := range rollCall.students {
+		if ok {
+			answered = append(answered, studentId)
+		} else {
+			missed = append(missed, studentId)
+		}
+	}
+	return answered, missed
+}
+
+type WsRollCallData struct {
+	Count          int `json:"count"`
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+type WsRollCall struct {
+	Event string         `json:"event"`
+	Data  WsRollCallData `json:"data"`
+}
+
+type WsRollCallPromptData struct {
+	RollCallID string    `json:"rollCallId"`
+	StudentIDs []string  `json:"studentIds,omitempty"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type WsRollCallPrompt struct {
+	Event string               `json:"event"`
+	Data  WsRollCallPromptData `json:"data"`
+}
+
+type WsRollCallAnswerData struct {
+	RollCallID string `json:"rollCallId"`
+}
+
+type WsRollCallAnswer struct {
+	Event string               `json:"event"`
+	Data  WsRollCallAnswerData `json:"data"`
+}
+
+type WsRollCallResultData struct {
+	RollCallID string           `json:"rollCallId"`
+	Answered   []string         `json:"answered"`
+	Missed     []string         `json:"missed"`
+	Action     string           `json:"action"`
+	Marks      []AttendanceData `json:"marks,omitempty"`
+}
+
+type WsRollCallResult struct {
+	Event string               `json:"event"`
+	Data  WsRollCallResultData `json:"data"`
+}
+
+// WsRollCallOutcome tells a picked student how the roll call went for them
+// alone. Status is their new mark when it was downgraded.
+type WsRollCallOutcomeData struct {
+	RollCallID string `json:"rollCallId"`
+	Answered   bool   `json:"answered"`
+	Status     string `json:"status,omitempty"`
+}
+
+type WsRollCallOutcome struct {
+	Event string                `json:"event"`
+	Data  WsRollCallOutcomeData `json:"data"`
+}
+
+func (w WsRollCallPrompt) EventName() string  { return w.Event }
+func (w WsRollCallResult) EventName() string  { return w.Event }
+func (w WsRollCallOutcome) EventName() string { return w.Event }
+
+// pickRollCall picks up to count random students whose mark counts as
+// present. The caller must hold the session lock.
+func pickRollCall(session *data.Session, count int) []string {
+	candidates := []string{}
+	for studentId, mark := range session.AttendanceStatus {
+		rule, ok := data.FindStatusRule(session.CustomStatuses, mark.Status)
+		if ok && rule.CountsAs == data.CountsAsPresent {
+			candidates = append(candidates, studentId)
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if count < len(candidates) {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+// wsRollCall handles the ROLL_CALL event. The picked students are prompted
+// on their sockets and the teacher gets the list of who was picked.
+func (c *Client) wsRollCall(db *mongo.Client, req WsReq) {
+	session, msg := c.teacherSession(req)
+	if session == nil {
+		c.sendError(req.RequestID, msg)
+		return
+	}
+
+	jsonData, _ := json.Marshal(req)
+	var rollCallReq WsRollCall
+	if err := json.Unmarshal(jsonData, &rollCallReq); err != nil || rollCallReq.Data.Count <= 0 || rollCallReq.Data.TimeoutSeconds < 0 {
+		c.sendError(req.RequestID, "Invalid format")
+		return
+	}
+
+	timeout := DefaultRollCallTimeout
+	if rollCallReq.Data.TimeoutSeconds > 0 {
+		timeout = time.Duration(rollCallReq.Data.TimeoutSeconds) * time.Second
+	}
+	if timeout > maxRollCallTimeout {
+		c.sendError(req.RequestID, "Timeout too long")
+		return
+	}
+
+	session.Lock()
+	picked := pickRollCall(session, rollCallReq.Data.Count)
+	marks := data.AttendanceStatus{}
+	for _, v := range picked {
+		marks[v] = session.AttendanceStatus[v]
+	}
+	session.Unlock()
+	if len(picked) == 0 {
+		c.sendError(req.RequestID, "No students marked present")
+		return
+	}
+
+	rollCall := &RollCall{
+		ID:        bson.NewObjectID().Hex(),
+		SessionID: session.ID,
+		ClassID:   session.ClassID,
+		Deadline:  time.Now().UTC().Add(timeout),
+		students:  map[string]bool{},
+		marks:     marks,
+	}
+	for _, v := range picked {
+		rollCall.students[v] = false
+	}
+	ActiveRollCalls.Add(rollCall)
+
+	c.hub.direct <- &DirectMessage{
+		ClassID: rollCall.ClassID.Hex(),
+		UserIDs: picked,
+		Text: WsRollCallPrompt{
+			Event: "ROLL_CALL",
+			Data: WsRollCallPromptData{
+				RollCallID: rollCall.ID,
+				ExpiresAt:  rollCall.Deadline,
+			},
+		},
+	}
+	c.send <- WsRollCallPrompt{
+		Event: "ROLL_CALL_STARTED",
+		Data: WsRollCallPromptData{
+			RollCallID: rollCall.ID,
+			StudentIDs: picked,
+			ExpiresAt:  rollCall.Deadline,
+		},
+	}
+	c.ack(req)
+
+	time.AfterFunc(timeout, func() {
+		finishRollCall(db, c.hub, rollCall)
+	})
+}
+
+// wsRollCallAnswer handles a picked student's ROLL_CALL_ANSWER event.
+func (c *Client) wsRollCallAnswer(req WsReq) {
+	if c.role != "student" {
+		c.sendError(req.RequestID, "Forbidden, student event only")
+		return
+	}
+
+	jsonData, _ := json.Marshal(req)
+	var answer WsRollCallAnswer
+	if err := json.Unmarshal(jsonData, &answer); err != nil || answer.Data.RollCallID == "" {
+		c.sendError(req.RequestID, "Invalid format")
+		return
+	}
+
+	if !ActiveRollCalls.Answer(answer.Data.RollCallID, c.id) {
+		c.sendError(req.RequestID, "Roll call closed or not for you")
+		return
+	}
+	c.ack(req)
+}
+
+// finishRollCall applies the class policy to the students who did not
+// answer. The teacher gets the full result and each picked student only
+// their own outcome. Without a policy, missed students are flagged.
+func finishRollCall(db *mongo.Client, hub *Hub, rollCall *RollCall) {
+	answered, missed := ActiveRollCalls.Close(rollCall.ID)
+	if answered == nil {
+		return
+	}
+
+	result := WsRollCallResultData{
+		RollCallID: rollCall.ID,
+		Answered:   answered,
+		Missed:     missed,
+		Action:     data.RollCallFlag,
+	}
+
+	// a roll call that outlived its session can only flag
+	session, ok := ActiveSessions.Get(rollCall.ClassID.Hex())
+	if ok && session.ID == rollCall.SessionID && len(missed) > 0 {
+		session.Lock()
+		policy := session.RollCallPolicy
+		if policy != nil && policy.Action == data.RollCallDowngrade {
+			marks, err := downgradeMissed(db, session, policy, rollCall.marks, missed)
+			if err != nil {
+				util.PrintError(err, "saving roll call marks err")
+			} else {
+				result.Action = data.RollCallDowngrade
+				result.Marks = marks
+			}
+		}
+		session.Unlock()
+	}
+
+	if result.Action == data.RollCallFlag {
+		for _, studentId := range missed {
+			reportSuspiciousCheckIn(db, hub, &data.CheckInFlag{
+				ID:        bson.NewObjectID(),
+				SessionID: rollCall.SessionID,
+				ClassID:   rollCall.ClassID,
+				StudentID: studentId,
+				Reasons:   []string{MissedRollCall},
+				CreatedAt: time.Now().UTC(),
+			})
+		}
+	}
+
+	hub.sendToTeachers(rollCall.ClassID.Hex(), WsRollCallResult{
+		Event: "ROLL_CALL_RESULT",
+		Data:  result,
+	})
+
+	downgraded := map[string]string{}
+	for _, v := range result.Marks {
+		downgraded[v.StudentID] = v.Status
+	}
+	outcome := func(studentId string, answered bool) {
+		hub.direct <- &DirectMessage{
+			ClassID: rollCall.ClassID.Hex(),
+			UserIDs: []string{studentId},
+			Text: WsRollCallOutcome{
+				Event: "ROLL_CALL_OUTCOME",
+				Data: WsRollCallOutcomeData{
+					RollCallID: rollCall.ID,
+					Answered:   answered,
+					Status:     downgraded[studentId],
+				},
+			},
+		}
+	}
+	for _, studentId := range answered {
+		outcome(studentId, true)
+	}
+	for _, studentId := range missed {
+		outcome(studentId, false)
+	}
+}
+
+// downgradeMissed changes the marks of the students who missed the roll
+// call. A mark that changed since the student was picked is left alone. The
+// caller must hold the session lock.
+func downgradeMissed(db *mongo.Client, session *data.Session, policy *data.RollCallPolicy, picked data.AttendanceStatus, missed []string) ([]AttendanceData, error) {
+	status := policy.DowngradeTo
+	if status == "" {
+		status = data.StatusAbsent
+	}
+
+	now := time.Now().UTC()
+	marks := data.AttendanceStatus{}
+	for _, studentId := range missed {
+		mark, ok := session.AttendanceStatus[studentId]
+		if !ok {
+			continue
+		}
+		if was := picked[studentId]; mark.Status != was.Status || !mark.MarkedAt.Equal(was.MarkedAt) {
+			continue
+		}
+		mark.Status = status
+		mark.MarkedAt = now
+		mark.Method = RollCallMissed
+		marks[studentId] = mark
+	}
+	if len(marks) == 0 {
+		return []AttendanceData{}, nil
+	}
+
+	if err := saveMarks(db, session, marks); err != nil {
+		return nil, err
+	}
+
+	applied := []AttendanceData{}
+	for studentId, mark := range marks {
+		session.AttendanceStatus[studentId] = mark
+		applied = append(applied, AttendanceData{StudentID: studentId, Status: mark.Status})
+	}
+	return applied, nil
+}
+
+// SetRollCallPolicy sets what happens to students who miss a roll call. It
+// applies to sessions started afterwards.
+func SetRollCallPolicy(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ReqBody := data.RollCallPolicy{}
+
+		err := c.ShouldBind(&ReqBody)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			c.Abort()
+			util.PrintError(err, "validation err")
+			return
+		}
+
+		if ReqBody.Action != data.RollCallDowngrade {
+			ReqBody.DowngradeTo = ""
+		} else if ReqBody.DowngradeTo != "" {
+			customStatuses, _ := c.Get("customStatuses")
+			custom, _ := customStatuses.([]data.StatusRule)
+			if _, ok := data.FindStatusRule(custom, ReqBody.DowngradeTo); !ok {
+				c.JSON(400, gin.H{
+					"success": false,
+					"error":   "Invalid status",
+				})
+				c.Abort()
+				return
+			}
+		}
+
+		classId, _ := bson.ObjectIDFromHex(c.GetString("classId"))
+
+		update := bson.M{
+			"$set": bson.M{
+				"roll_call_policy": ReqBody,
+			},
+		}
+
+		var updatedClass data.Class
+		err = db.Database("attendance").Collection("class").FindOneAndUpdate(c, bson.M{"_id": classId}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updatedClass)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"success": false,
+				"error":   "Internal Server Error",
+			})
+			c.Abort()
+			util.PrintError(err, "roll call policy update err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data": gin.H{
+				"rollCallPolicy": updatedClass.RollCallPolicy,
+			},
+		})
+	}
+}
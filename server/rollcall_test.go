@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// testRollCallSession has three students marked present. The teacher then
+// marks the second late and the third present again, after the roll call
+// picked them.
+func testRollCallSession() (session *data.Session, picked data.AttendanceStatus, students []string) {
+	pickedAt := time.Now().UTC().Add(-time.Minute)
+	students = []string{bson.NewObjectID().Hex(), bson.NewObjectID().Hex(), bson.NewObjectID().Hex()}
+
+	picked = data.AttendanceStatus{}
+	for _, v := range students {
+		picked[v] = data.Mark{Status: data.StatusPresent, MarkedAt: pickedAt}
+	}
+
+	session = &data.Session{
+		ID:      bson.NewObjectID(),
+		State:   data.SessionOpen,
+		ClassID: bson.NewObjectID(),
+		AttendanceStatus: data.AttendanceStatus{
+			students[0]: picked[students[0]],
+			students[1]: {Status: data.StatusLate, MarkedAt: time.Now().UTC()},
+			students[2]: {Status: data.StatusPresent, MarkedAt: time.Now().UTC()},
+		},
+	}
+	return session, picked, students
+}
+
+func TestDowngradeMissedSkipsChangedMarks(t *testing.T) {
+	session, picked, students := testRollCallSession()
+	policy := &data.RollCallPolicy{Action: data.RollCallDowngrade}
+
+	// only changed marks missed the roll call, so there is nothing to save
+	marks, err := downgradeMissed(nil, session, policy, picked, students[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 0 {
+		t.Fatalf("downgraded %v, want none", marks)
+	}
+	if got := session.AttendanceStatus[students[1]].Status; got != data.StatusLate {
+		t.Fatalf("teacher's mark = %s, want %s", got, data.StatusLate)
+	}
+}
+
+func TestDowngradeMissed(t *testing.T) {
+	db := testMongo(t)
+	session, picked, students := testRollCallSession()
+	if err := saveSession(db, session); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sessionsCollection(db).DeleteOne(context.Background(), bson.M{"_id": session.ID}) })
+
+	policy := &data.RollCallPolicy{Action: data.RollCallDowngrade, DowngradeTo: data.StatusLate}
+	marks, err := downgradeMissed(db, session, policy, picked, students)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 1 || marks[0].StudentID != students[0] {
+		t.Fatalf("downgraded %v, want only %s", marks, students[0])
+	}
+
+	want := []string{data.StatusLate, data.StatusLate, data.StatusPresent}
+	for i, v := range students {
+		if got := session.AttendanceStatus[v].Status; got != want[i] {
+			t.Errorf("student %d status = %s, want %s", i, got, want[i])
+		}
+	}
+	if got := session.AttendanceStatus[students[0]].Method; got != RollCallMissed {
+		t.Errorf("downgraded mark method = %q, want %q", got, RollCallMissed)
+	}
+}
@@ -1,14 +1,18 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 
+	"github.com/dinesht04/ws-attendance/blob"
 	"github.com/dinesht04/ws-attendance/data"
 	"github.com/dinesht04/ws-attendance/util"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
@@ -45,7 +49,7 @@ func (p *OpenSocketsStruct) SendMessage() {
 
 var SocketList OpenSocketsStruct
 
-func Auth() gin.HandlerFunc {
+func Auth(db *mongo.Client) gin.HandlerFunc {
 	// <---
 	// This is part one
 	// --->
@@ -69,9 +73,7 @@ func Auth() gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(header, func(t *jwt.Token) (any, error) {
-			return []byte(secret), nil
-		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		claims, err := verifyAccessToken(c, db, header)
 		if err != nil {
 			c.JSON(401, gin.H{
 				"success": false,
@@ -80,39 +82,13 @@ func Auth() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+		role, userId := claims.Role, claims.UserId
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			c.Abort()
-			return
-		}
-
-		role, ok := claims["role"].(string)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			c.Abort()
-			return
-		}
-		userId, ok := claims["userId"].(string)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			c.Abort()
-			return
-		}
-
-		if role == "student" || role == "teacher" {
+		if role == "student" || role == "teacher" || role == "admin" {
 			c.Set("role", role)
 			c.Set("userId", userId)
+			c.Set("jti", claims.ID)
+			c.Set("sid", claims.SessionID)
 			c.Next()
 		} else {
 			c.JSON(401, gin.H{
@@ -126,7 +102,7 @@ func Auth() gin.HandlerFunc {
 	}
 }
 
-func QueryParamsAuth() gin.HandlerFunc {
+func QueryParamsAuth(db *mongo.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		jwToken, exists := c.GetQuery("token")
 		if !exists {
@@ -134,9 +110,7 @@ func QueryParamsAuth() gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(jwToken, func(t *jwt.Token) (any, error) {
-			return []byte(secret), nil
-		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		claims, err := verifyAccessToken(c, db, jwToken)
 		if err != nil {
 			c.JSON(401, gin.H{
 				"success": false,
@@ -145,38 +119,13 @@ func QueryParamsAuth() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+		role, userId := claims.Role, claims.UserId
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			c.Abort()
-			return
-		}
-		role, ok := claims["role"].(string)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			c.Abort()
-			return
-		}
-		userId, ok := claims["userId"].(string)
-		if !ok {
-			c.JSON(401, gin.H{
-				"success": false,
-				"error":   "Unauthorized, token missing or invalid",
-			})
-			c.Abort()
-			return
-		}
-
-		if role == "student" || role == "teacher" {
+		if role == "student" || role == "teacher" || role == "admin" {
 			c.Set("role", role)
 			c.Set("userId", userId)
+			c.Set("jti", claims.ID)
+			c.Set("sid", claims.SessionID)
 			c.Next()
 		} else {
 			c.JSON(401, gin.H{
@@ -190,10 +139,11 @@ func QueryParamsAuth() gin.HandlerFunc {
 	}
 }
 
+// TeacherRoleAuth also lets admins through, since they manage every class.
 func TeacherRoleAuth() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
-		if c.GetString("role") == "teacher" {
+		if c.GetString("role") == "teacher" || c.GetString("role") == "admin" {
 			c.Next()
 		} else {
 			c.Abort()
@@ -260,6 +210,10 @@ func ClassParamBasedAuth(db *mongo.Client) gin.HandlerFunc {
 		c.Set("classId", Class.ID.Hex())
 		c.Set("teacherId", Class.TeacherID.Hex())
 		c.Set("className", Class.ClassName)
+		c.Set("customStatuses", Class.CustomStatuses)
+		c.Set("location", Class.Location)
+		c.Set("checkInWindow", Class.CheckInWindow)
+		c.Set("rollCallPolicy", Class.RollCallPolicy)
 
 		userId, err := bson.ObjectIDFromHex(c.GetString("userId"))
 		if err != nil {
@@ -272,9 +226,9 @@ func ClassParamBasedAuth(db *mongo.Client) gin.HandlerFunc {
 			return
 		}
 
-		if c.GetString("role") == "teacher" {
+		if c.GetString("role") == "teacher" || c.GetString("role") == "admin" {
 
-			if userId.Hex() != Class.TeacherID.Hex() {
+			if !managesClass(userId.Hex(), c.GetString("role"), Class.TeacherID) {
 				c.JSON(403, gin.H{
 					"success": false,
 					"error":   "Forbidden, not class teacher",
@@ -308,11 +262,16 @@ func ClassBodyBasedAuth(db *mongo.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		type StartReq struct {
-			ClassID string `json:"classId" binding:"required"`
+			ClassID string `json:"classId" form:"classId" binding:"required"`
 		}
 
+		// the body is kept around so the handler can bind its own fields
 		req := StartReq{}
-		if err := c.ShouldBind(&req); err != nil {
+		bind := c.ShouldBind
+		if c.Request.Method != http.MethodGet {
+			bind = func(obj any) error { return c.ShouldBindBodyWith(obj, binding.JSON) }
+		}
+		if err := bind(&req); err != nil {
 			c.JSON(400, gin.H{
 				"success": false,
 				"error":   "Invalid request schema",
@@ -354,6 +313,10 @@ func ClassBodyBasedAuth(db *mongo.Client) gin.HandlerFunc {
 		c.Set("classId", Class.ID)
 		c.Set("teacherId", Class.TeacherID.Hex())
 		c.Set("className", Class.ClassName)
+		c.Set("customStatuses", Class.CustomStatuses)
+		c.Set("location", Class.Location)
+		c.Set("checkInWindow", Class.CheckInWindow)
+		c.Set("rollCallPolicy", Class.RollCallPolicy)
 
 		userId, err := bson.ObjectIDFromHex(c.GetString("userId"))
 		if err != nil {
@@ -366,9 +329,9 @@ func ClassBodyBasedAuth(db *mongo.Client) gin.HandlerFunc {
 			return
 		}
 
-		if c.GetString("role") == "teacher" {
+		if c.GetString("role") == "teacher" || c.GetString("role") == "admin" {
 
-			if userId.Hex() != Class.TeacherID.Hex() {
+			if !managesClass(userId.Hex(), c.GetString("role"), Class.TeacherID) {
 				c.JSON(403, gin.H{
 					"success": false,
 					"error":   "Forbidden, not class teacher",
@@ -398,6 +361,72 @@ func ClassBodyBasedAuth(db *mongo.Client) gin.HandlerFunc {
 	}
 }
 
+// managesClass reports whether the user runs the class: its teacher, or any
+// admin. Every check that someone owns a class goes through here.
+func managesClass(userId string, role string, teacherId bson.ObjectID) bool {
+	return role == "admin" || (role == "teacher" && teacherId.Hex() == userId)
+}
+
+// authorizeClass loads the class and checks that the user teaches it, is
+// enrolled in it or is an admin. On failure it returns the status code and
+// error message to send back.
+func authorizeClass(ctx context.Context, db *mongo.Client, classId string, userId string, role string) (*data.Class, int, string) {
+	id, err := bson.ObjectIDFromHex(classId)
+	if err != nil {
+		util.PrintError(err, "object id err")
+		return nil, 401, "Unauthorized, token missing or invalid"
+	}
+
+	Class := data.Class{}
+
+	filter := bson.M{"_id": id}
+
+	err = db.Database("attendance").Collection("class").FindOne(ctx, filter).Decode(&Class)
+	if err != nil {
+		util.PrintError(err, "db finding err")
+		return nil, 404, "Class not found"
+	}
+
+	if role == "teacher" || role == "admin" {
+		if !managesClass(userId, role, Class.TeacherID) {
+			return nil, 403, "Forbidden, not class teacher"
+		}
+		return &Class, 200, ""
+	}
+
+	for _, v := range Class.StudentIDs {
+		if v.Hex() == userId {
+			return &Class, 200, ""
+		}
+	}
+	return nil, 403, "Forbidden, not enrolled in class"
+}
+
+// ClassQueryBasedAuth checks the optional classId query parameter, so a
+// websocket can be opened straight into a class room.
+func ClassQueryBasedAuth(db *mongo.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		classId, exists := c.GetQuery("classId")
+		if !exists {
+			c.Next()
+			return
+		}
+
+		Class, code, msg := authorizeClass(c, db, classId, c.GetString("userId"), c.GetString("role"))
+		if Class == nil {
+			c.JSON(code, gin.H{
+				"success": false,
+				"error":   msg,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("classId", Class.ID.Hex())
+		c.Next()
+	}
+}
+
 // func StudentAuth(params string) gin.HandlerFunc {
 // 	// <---
 // 	// This is part one
@@ -419,12 +448,84 @@ func ClassBodyBasedAuth(db *mongo.Client) gin.HandlerFunc {
 // 	}
 // }
 
-var ActiveSession data.Session
+// TrustedProxiesEnv lists, comma separated, the proxies whose X-Forwarded-For
+// is believed. Without it the client IP is always the peer address, since
+// anyone could send the header.
+const TrustedProxiesEnv = "TRUSTED_PROXIES"
+
+func trustedProxies() []string {
+	proxies := []string{}
+	for _, v := range strings.Split(os.Getenv(TrustedProxiesEnv), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			proxies = append(proxies, v)
+		}
+	}
+	if len(proxies) == 0 {
+		return nil
+	}
+	return proxies
+}
 
 func StartServer(db *mongo.Client) {
 	r := gin.Default()
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		panic(fmt.Errorf("trusted proxies err: %w", err))
+	}
 
-	ActiveSession.AttendanceStatus = make(data.AttendanceStatus)
+	if err := ActiveSessions.LoadOpenSessions(db); err != nil {
+		util.PrintError(err, "loading open sessions err")
+	}
+
+	keys, err := LoadKeySet()
+	if err != nil {
+		panic(fmt.Errorf("signing keys err: %w", err))
+	}
+	signingKeys = keys
+
+	if err := EnsureTokenIndexes(db); err != nil {
+		util.PrintError(err, "creating token indexes err")
+	}
+	if err := EnsureRecordIndexes(db); err != nil {
+		util.PrintError(err, "creating record indexes err")
+	}
+
+	if err := EnsureAdmin(db); err != nil {
+		util.PrintError(err, "promoting admin err")
+	}
+
+	mailer, err := NewMailer()
+	if err != nil {
+		panic(fmt.Errorf("mailer err: %w", err))
+	}
+
+	limits, err := NewLoginLimits()
+	if err != nil {
+		panic(fmt.Errorf("login limits err: %w", err))
+	}
+
+	store, err := blob.NewLocalStore(AttachmentDir)
+	if err != nil {
+		panic(fmt.Errorf("attachment store err: %w", err))
+	}
+
+	hub := &Hub{
+		Clients:    make(map[*Client]bool),
+		rooms:      make(map[string]map[*Client]bool),
+		seq:        make(map[string]uint64),
+		log:        make(map[string][]SequencedEvent),
+		presence:   make(map[string]map[string]*Presence),
+		join:       make(chan *RoomJoin),
+		direct:     make(chan *DirectMessage),
+		broadcast:  make(chan *Message),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		revoke:     make(chan []string),
+		db:         db,
+	}
+
+	go hub.Run()
+	go expireSessions(db, hub)
+	go watchLockouts(db, limits)
 
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -432,44 +533,79 @@ func StartServer(db *mongo.Client) {
 		})
 	})
 
+	r.GET("/.well-known/jwks.json", handleJWKS())
+
 	{
 		auth := r.Group("/auth")
-		auth.POST("/signup", HandleSignup(db))
-		auth.POST("/login", HandleLogin(db))
+		auth.POST("/signup", HandleSignup(db, mailer))
+		auth.POST("/login", HandleLogin(db, limits))
 		auth.GET("/me", HandleMe(db))
+		auth.POST("/refresh", HandleRefresh(db, hub))
+		auth.POST("/logout", Auth(db), HandleLogout(db, hub))
+		auth.POST("/verify-email", VerifyEmail(db))
+		auth.POST("/resend-verification", ResendVerification(db, mailer, limits))
+		auth.POST("/forgot-password", ForgotPassword(db, mailer, limits))
+		auth.POST("/reset-password", ResetPassword(db, hub, limits))
 	}
 
 	{
-		class := r.Group("/class", Auth())
+		class := r.Group("/class", Auth(db))
 		class.POST("/", TeacherRoleAuth(), CreateClass(db))
 		class.POST("/:id/add-student", TeacherRoleAuth(), AddStudent(db))
 		class.GET("/:id/", ClassParamBasedAuth(db), GetClass(db))
 		class.GET("/:id/my-attendance", StudentRoleAuth(), ClassParamBasedAuth(db), getMyAttendance(db))
+		class.PUT("/:id/statuses", TeacherRoleAuth(), ClassParamBasedAuth(db), SetCustomStatuses(db))
+		class.PUT("/:id/location", TeacherRoleAuth(), ClassParamBasedAuth(db), SetClassLocation(db))
+		class.DELETE("/:id/location", TeacherRoleAuth(), ClassParamBasedAuth(db), ClearClassLocation(db))
+		class.PUT("/:id/checkin-window", TeacherRoleAuth(), ClassParamBasedAuth(db), SetCheckInWindow(db))
+		class.PUT("/:id/roll-call-policy", TeacherRoleAuth(), ClassParamBasedAuth(db), SetRollCallPolicy(db))
+		class.GET("/:id/suspicious-checkins", TeacherRoleAuth(), ClassParamBasedAuth(db), getSuspiciousCheckIns(db))
+		class.POST("/:id/leave-requests", StudentRoleAuth(), ClassParamBasedAuth(db), submitLeaveRequest(db, store))
+		class.GET("/:id/leave-requests", ClassParamBasedAuth(db), getLeaveRequests(db))
+		class.GET("/:id/leave-requests/:requestId/attachment", ClassParamBasedAuth(db), getLeaveAttachment(db, store))
+		class.POST("/:id/leave-requests/:requestId/approve", TeacherRoleAuth(), ClassParamBasedAuth(db), reviewLeaveRequest(db, true))
+		class.POST("/:id/leave-requests/:requestId/reject", TeacherRoleAuth(), ClassParamBasedAuth(db), reviewLeaveRequest(db, false))
+		class.GET("/:id/records/:recordId", ClassParamBasedAuth(db), getRecord(db))
+		class.PATCH("/:id/records/:recordId", TeacherRoleAuth(), ClassParamBasedAuth(db), correctRecord(db))
+		class.GET("/:id/sessions", ClassParamBasedAuth(db), getClassSessions(db))
+		class.GET("/:id/sessions/:sessionId", ClassParamBasedAuth(db), getClassSession(db))
 	}
 
 	{
-		students := r.Group("/students", Auth())
-		students.GET("/", TeacherRoleAuth(), getStudents(db))
+		admin := r.Group("/admin", Auth(db), AdminRoleAuth())
+		admin.GET("/users", listUsers(db))
+		admin.GET("/users/:userId", getUser(db))
+		admin.PATCH("/users/:userId", updateUser(db))
+		admin.PUT("/users/:userId/role", setUserRole(db, hub))
+		admin.POST("/users/:userId/deactivate", setUserActive(db, hub, false))
+		admin.POST("/users/:userId/activate", setUserActive(db, hub, true))
+		admin.POST("/users/:userId/unlock", unlockUser(db, limits))
+		admin.DELETE("/users/:userId", deleteUser(db, hub))
+		admin.GET("/classes", listClasses(db))
 	}
 
 	{
-		attendance := r.Group("/attendance", Auth())
-		attendance.POST("/start", TeacherRoleAuth(), ClassBodyBasedAuth(db), startAttendance(db))
+		students := r.Group("/students", Auth(db))
+		students.GET("/", TeacherRoleAuth(), getStudents(db))
 	}
 
-	hub := &Hub{
-		Clients:    make(map[*Client]bool),
-		broadcast:  make(chan *Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		db:         db,
+	{
+		attendance := r.Group("/attendance", Auth(db))
+		attendance.POST("/start", TeacherRoleAuth(), ClassBodyBasedAuth(db), startAttendance(db, hub))
+		attendance.GET("/current", TeacherRoleAuth(), ClassBodyBasedAuth(db), getCurrentSession(db))
+		attendance.POST("/end", TeacherRoleAuth(), ClassBodyBasedAuth(db), endAttendance(db, hub))
+		attendance.POST("/cancel", TeacherRoleAuth(), ClassBodyBasedAuth(db), cancelAttendance(db, hub))
+		attendance.POST("/pause", TeacherRoleAuth(), ClassBodyBasedAuth(db), pauseAttendance(db, hub, true))
+		attendance.POST("/resume", TeacherRoleAuth(), ClassBodyBasedAuth(db), pauseAttendance(db, hub, false))
+		attendance.GET("/code", TeacherRoleAuth(), ClassBodyBasedAuth(db), getCheckInCode(db))
+		attendance.POST("/check-in", StudentRoleAuth(), ClassBodyBasedAuth(db), handleCheckIn(db, hub))
+		attendance.POST("/qr-check-in", StudentRoleAuth(), handleQRCheckIn(db, hub))
+		attendance.GET("/:id/qr", TeacherRoleAuth(), ClassParamBasedAuth(db), getCheckInQR(db))
 	}
 
-	go hub.Run()
-
 	{
 		ws := r.Group("/ws")
-		ws.GET("/", QueryParamsAuth(), handleWebsocket(db, hub))
+		ws.GET("/", QueryParamsAuth(db), ClassQueryBasedAuth(db), handleWebsocket(db, hub))
 	}
 
 	r.Run()
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// SessionRegistry holds every running attendance session keyed by class id,
+// so several classes can take attendance at the same time.
+type SessionRegistry struct {
+	sync.RWMutex
+	list map[string]*data.Session
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		list: make(map[string]*data.Session),
+	}
+}
+
+// ErrSessionOpen is returned when the class already has a running session.
+var ErrSessionOpen = errors.New("session already open for class")
+
+// SessionRules are the class's rules a session copies when it starts.
+type SessionRules struct {
+	CustomStatuses []data.StatusRule
+	Location       *data.ClassLocation
+	RollCallPolicy *data.RollCallPolicy
+}
+
+// Start opens a fresh session for the class. It fails while the class has a
+// session that was not ended yet. The session is complete before it is
+// registered, since marking can reach it from then on.
+func (r *SessionRegistry) Start(classId bson.ObjectID, teacherId bson.ObjectID, studentIds []bson.ObjectID, settings data.SessionSettings, rules SessionRules) (*data.Session, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.list[classId.Hex()]; ok {
+		return nil, ErrSessionOpen
+	}
+
+	now := time.Now().UTC()
+	session := &data.Session{
+		ID:               bson.NewObjectID(),
+		State:            data.SessionOpen,
+		ClassID:          classId,
+		TeacherID:        teacherId,
+		StudentIDs:       studentIds,
+		CustomStatuses:   rules.CustomStatuses,
+		Location:         rules.Location,
+		RollCallPolicy:   rules.RollCallPolicy,
+		StartedAt:        now.String(),
+		ExpiresAt:        now.Add(settings.MaxDuration),
+		LastActivityAt:   now,
+		Settings:         settings,
+		CheckInSecret:    newCheckInSecret(),
+		AttendanceStatus: make(data.AttendanceStatus),
+	}
+	if settings.OnTimeWindow > 0 {
+		session.OnTimeUntil = now.Add(settings.OnTimeWindow)
+	}
+	if settings.Cutoff > 0 {
+		session.CutoffAt = now.Add(settings.Cutoff)
+	}
+	r.list[classId.Hex()] = session
+
+	return session, nil
+}
+
+// Restore puts a session loaded from the database back into the registry. It
+// fails if the class already has a session.
+func (r *SessionRegistry) Restore(session *data.Session) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.list[session.ClassID.Hex()]; ok {
+		return ErrSessionOpen
+	}
+
+	if session.AttendanceStatus == nil {
+		session.AttendanceStatus = make(data.AttendanceStatus)
+	}
+	if len(session.CheckInSecret) == 0 {
+		session.CheckInSecret = newCheckInSecret()
+	}
+	r.list[session.ClassID.Hex()] = session
+	return nil
+}
+
+func (r *SessionRegistry) Get(classId string) (*data.Session, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	session, ok := r.list[classId]
+	return session, ok
+}
+
+// Remove takes the session out of the registry. A newer session of the same
+// class that replaced it is left alone.
+func (r *SessionRegistry) Remove(session *data.Session) {
+	r.Lock()
+	defer r.Unlock()
+
+	classId := session.ClassID.Hex()
+	if r.list[classId] == session {
+		delete(r.list, classId)
+	}
+}
+
+// All returns a snapshot of the running sessions.
+func (r *SessionRegistry) All() []*data.Session {
+	r.RLock()
+	defer r.RUnlock()
+
+	sessions := make([]*data.Session, 0, len(r.list))
+	for _, session := range r.list {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// ForTeacher returns every session run by the given teacher.
+func (r *SessionRegistry) ForTeacher(teacherId string) []*data.Session {
+	r.RLock()
+	defer r.RUnlock()
+
+	sessions := []*data.Session{}
+	for _, session := range r.list {
+		if session.TeacherID.Hex() == teacherId {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// ForStudent returns every session of a class the given student is enrolled
+// in.
+func (r *SessionRegistry) ForStudent(studentId string) []*data.Session {
+	r.RLock()
+	defer r.RUnlock()
+
+	sessions := []*data.Session{}
+	for _, session := range r.list {
+		if onRoster(session, studentId) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// onRoster reports whether the student is enrolled in the session's class.
+func onRoster(session *data.Session, studentId string) bool {
+	for _, v := range session.StudentIDs {
+		if v.Hex() == studentId {
+			return true
+		}
+	}
+	return false
+}
+
+var ActiveSessions = NewSessionRegistry()
+
+func sessionsCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("sessions")
+}
+
+// saveSession writes the whole session document. The caller must hold the
+// session lock.
+func saveSession(db *mongo.Client, session *data.Session) error {
+	_, err := sessionsCollection(db).ReplaceOne(context.Background(), bson.M{"_id": session.ID}, session, options.Replace().SetUpsert(true))
+	return err
+}
+
+// saveMark writes a single mark through to the stored session. The caller
+// must hold the session lock.
+func saveMark(db *mongo.Client, session *data.Session, studentId string, mark data.Mark) error {
+	return saveMarks(db, session, data.AttendanceStatus{studentId: mark})
+}
+
+// EnsureRecordIndexes allows one record per student and session, which keeps
+// rewriting the records of a session idempotent.
+func EnsureRecordIndexes(db *mongo.Client) error {
+	_, err := recordsCollection(db).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "sessionid", Value: 1}, {Key: "studentid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// saveMarks writes several marks through to the stored session in one update.
+// The caller must hold the session lock.
+func saveMarks(db *mongo.Client, session *data.Session, marks data.AttendanceStatus) error {
+	set := bson.M{}
+	for studentId, mark := range marks {
+		// student ids end up in field paths, so anything but an object id
+		// could write outside the attendance map
+		if _, err := bson.ObjectIDFromHex(studentId); err != nil {
+			return fmt.Errorf("invalid student id %q", studentId)
+		}
+		set["attendance_status."+studentId] = mark
+	}
+	session.LastActivityAt = time.Now().UTC()
+	set["last_activity_at"] = session.LastActivityAt
+	_, err := sessionsCollection(db).UpdateByID(context.Background(), session.ID, bson.M{"$set": set})
+	return err
+}
+
+// LoadOpenSessions reloads sessions that were still running when the server
+// stopped, so teachers can carry on marking, and sessions whose records were
+// not all written, so finishing them is retried. Should a class have several,
+// the latest is restored.
+func (r *SessionRegistry) LoadOpenSessions(db *mongo.Client) error {
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	filter := bson.M{"state": bson.M{"$in": []string{data.SessionOpen, data.SessionClosing}}}
+	cur, err := sessionsCollection(db).Find(context.Background(), filter, opts)
+	if err != nil {
+		return err
+	}
+
+	sessions := []*data.Session{}
+	if err := cur.All(context.Background(), &sessions); err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		applyDefaultTimeouts(session, time.Now().UTC())
+		if err := r.Restore(session); err != nil {
+			util.PrintError(err, "skipping older session "+session.ID.Hex())
+		}
+	}
+	return nil
+}
+
+// applyDefaultTimeouts gives a session stored before sessions had timeouts
+// the default ones, so it still expires. Its maximum duration counts from
+// when it was started.
+func applyDefaultTimeouts(session *data.Session, now time.Time) {
+	if session.Settings.MaxDuration == 0 {
+		session.Settings.MaxDuration = DefaultMaxSessionDuration
+	}
+	if session.Settings.IdleTimeout == 0 {
+		session.Settings.IdleTimeout = DefaultIdleTimeout
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = session.ID.Timestamp().UTC().Add(session.Settings.MaxDuration)
+	}
+	if session.LastActivityAt.IsZero() {
+		session.LastActivityAt = now
+	}
+}
+
+// summarizeSession counts the marks of a session by status. The caller must
+// hold the session lock.
+func summarizeSession(session *data.Session) data.SessionSummary {
+	return data.Summarize(session.AttendanceStatus, session.CustomStatuses)
+}
+
+// ErrSessionFinalized is returned when a session was already persisted, so
+// sending DONE twice does not write the records twice.
+var ErrSessionFinalized = errors.New("session already finalized")
+
+// finalizeSession marks every roster student without a mark absent, or
+// present when they stayed connected long enough and the session asks for
+// it, writes the records and closes the session. It needs no transaction: the
+// session is moved to closing only while it is open, the records are written
+// idempotently and only then is it finished, so a failed attempt can simply be
+// run again.
+func finalizeSession(db *mongo.Client, hub *Hub, session *data.Session) (WsDone, error) {
+	session.Lock()
+	defer session.Unlock()
+
+	if session.State != data.SessionOpen && session.State != data.SessionClosing {
+		return WsDone{}, ErrSessionFinalized
+	}
+
+	//get all students from class id
+	filter := bson.M{
+		"_id": session.ClassID,
+	}
+	var class data.Class
+	err := db.Database("attendance").Collection("class").FindOne(context.Background(), filter).Decode(&class)
+	if err != nil {
+		return WsDone{}, err
+	}
+
+	//mark the students who havent joined absent, on a copy so a failed
+	//write leaves the live session untouched
+	statuses := make(data.AttendanceStatus, len(session.AttendanceStatus))
+	for k, v := range session.AttendanceStatus {
+		statuses[k] = v
+	}
+	excused, err := excusedStudents(context.Background(), db, session)
+	if err != nil {
+		return WsDone{}, err
+	}
+	now := time.Now().UTC()
+	online := map[string]time.Duration{}
+	required := time.Duration(session.Settings.AutoPresentShare * float64(now.Sub(session.ID.Timestamp())))
+	if session.Settings.AutoPresentShare > 0 {
+		online = hub.OnlineDurations(session.ClassID.Hex(), now)
+	}
+	for _, v := range class.StudentIDs {
+		if _, ok := statuses[v.Hex()]; !ok {
+			mark := data.Mark{Status: data.StatusAbsent, MarkedAt: now}
+			if d, ok := online[v.Hex()]; ok && d >= required {
+				mark.Status = data.StatusPresent
+				mark.Method = MarkedByPresence
+			} else if excused[v.Hex()] {
+				mark.Status = data.StatusExcused
+			}
+			statuses[v.Hex()] = mark
+		}
+	}
+
+	records := []mongo.WriteModel{}
+	for k, v := range statuses {
+		studentId, err := bson.ObjectIDFromHex(k)
+		if err != nil {
+			util.PrintError(err, "skipping invalid student id "+k)
+			continue
+		}
+
+		// one record per student and session, so a retried write updates
+		// the records an earlier attempt left instead of adding more
+		record := bson.M{
+			"classid":  session.ClassID,
+			"status":   v.Status,
+			"markedat": v.MarkedAt,
+		}
+		if v.Method != "" {
+			record["method"] = v.Method
+		}
+		if v.Location != nil {
+			record["location"] = v.Location
+		}
+		records = append(records, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"sessionid": session.ID, "studentid": studentId}).
+			SetUpdate(bson.M{"$set": record, "$setOnInsert": bson.M{"_id": bson.NewObjectID()}}).
+			SetUpsert(true))
+	}
+
+	summary := data.Summarize(statuses, session.CustomStatuses)
+	endedAt := time.Now().UTC().String()
+
+	// claim the session first, so a session finished elsewhere never gets
+	// its records rewritten
+	guard := bson.M{
+		"_id":   session.ID,
+		"state": bson.M{"$in": []string{data.SessionOpen, data.SessionClosing}},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"state":             data.SessionClosing,
+			"ended_at":          endedAt,
+			"summary":           summary,
+			"attendance_status": statuses,
+		},
+	}
+	res, err := sessionsCollection(db).UpdateOne(context.Background(), guard, update)
+	if err != nil {
+		return WsDone{}, err
+	}
+	if res.MatchedCount == 0 {
+		session.State = data.SessionFinished
+		ActiveSessions.Remove(session)
+		return WsDone{}, ErrSessionFinalized
+	}
+	session.State = data.SessionClosing
+
+	if len(records) > 0 {
+		_, err := recordsCollection(db).BulkWrite(context.Background(), records, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return WsDone{}, err
+		}
+	}
+
+	guard = bson.M{
+		"_id":   session.ID,
+		"state": data.SessionClosing,
+	}
+	_, err = sessionsCollection(db).UpdateOne(context.Background(), guard, bson.M{"$set": bson.M{"state": data.SessionFinished}})
+	if err != nil {
+		return WsDone{}, err
+	}
+
+	session.AttendanceStatus = statuses
+	session.State = data.SessionFinished
+	session.EndedAt = endedAt
+	session.Summary = summary
+
+	ActiveSessions.Remove(session)
+
+	return WsDone{
+		Event: "EVENT",
+		Data: WsDoneData{
+			Message:  "Attendance Persisted",
+			Present:  summary.Present,
+			Absent:   summary.Absent,
+			Total:    summary.Total,
+			ByStatus: summary.ByStatus,
+		},
+	}, nil
+}
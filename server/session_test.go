@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestSessionRegistryRemove(t *testing.T) {
+	classId := bson.NewObjectID()
+
+	tests := []struct {
+		name string
+		// remove is called with the first session after the second one
+		// replaced it when replaced is set
+		replaced bool
+		want     bool
+	}{
+		{"current session", false, false},
+		{"session replaced by a newer one", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewSessionRegistry()
+			first, err := r.Start(classId, bson.NewObjectID(), nil, data.SessionSettings{}, SessionRules{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.replaced {
+				r.Remove(first)
+				if _, err := r.Start(classId, bson.NewObjectID(), nil, data.SessionSettings{}, SessionRules{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r.Remove(first)
+			if _, ok := r.Get(classId.Hex()); ok != tt.want {
+				t.Fatalf("class has a session = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+// testFinalizeSession stores a class of two students and an open session of
+// it where only the first was marked.
+func testFinalizeSession(t *testing.T) (*data.Session, []bson.ObjectID) {
+	t.Helper()
+	db := testMongo(t)
+	ctx := context.Background()
+
+	students := []bson.ObjectID{bson.NewObjectID(), bson.NewObjectID()}
+	class := data.Class{
+		ID:         bson.NewObjectID(),
+		ClassName:  "finalize test",
+		TeacherID:  bson.NewObjectID(),
+		StudentIDs: students,
+	}
+	if _, err := db.Database("attendance").Collection("class").InsertOne(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &data.Session{
+		ID:         bson.NewObjectID(),
+		State:      data.SessionOpen,
+		ClassID:    class.ID,
+		TeacherID:  class.TeacherID,
+		StudentIDs: students,
+		AttendanceStatus: data.AttendanceStatus{
+			students[0].Hex(): {Status: data.StatusPresent, MarkedAt: time.Now().UTC()},
+		},
+	}
+	if err := saveSession(db, session); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Database("attendance").Collection("class").DeleteOne(ctx, bson.M{"_id": class.ID})
+		sessionsCollection(db).DeleteOne(ctx, bson.M{"_id": session.ID})
+		recordsCollection(db).DeleteMany(ctx, bson.M{"sessionid": session.ID})
+	})
+	return session, students
+}
+
+func TestFinalizeSession(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	if err := EnsureRecordIndexes(db); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// before runs ahead of finalizing, to leave the state an earlier
+		// attempt would have
+		before func(t *testing.T, session *data.Session, students []bson.ObjectID)
+		err    error
+	}{
+		{"open session", func(t *testing.T, session *data.Session, students []bson.ObjectID) {}, nil},
+		{"earlier attempt wrote some records", func(t *testing.T, session *data.Session, students []bson.ObjectID) {
+			_, err := sessionsCollection(db).UpdateByID(ctx, session.ID, bson.M{"$set": bson.M{"state": data.SessionClosing}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = recordsCollection(db).InsertOne(ctx, data.Attendance{
+				ID:        bson.NewObjectID(),
+				SessionID: session.ID,
+				ClassID:   session.ClassID,
+				StudentID: students[0],
+				Status:    data.StatusPresent,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			session.State = data.SessionClosing
+		}, nil},
+		{"finished elsewhere", func(t *testing.T, session *data.Session, students []bson.ObjectID) {
+			_, err := sessionsCollection(db).UpdateByID(ctx, session.ID, bson.M{"$set": bson.M{"state": data.SessionFinished}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, ErrSessionFinalized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, students := testFinalizeSession(t)
+			tt.before(t, session, students)
+
+			_, err := finalizeSession(db, nil, session)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("finalizeSession() err = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				if n, _ := recordsCollection(db).CountDocuments(ctx, bson.M{"sessionid": session.ID, "status": data.StatusAbsent}); n != 0 {
+					t.Fatalf("%d records written for a session finished elsewhere", n)
+				}
+				return
+			}
+
+			stored := data.Session{}
+			if err := sessionsCollection(db).FindOne(ctx, bson.M{"_id": session.ID}).Decode(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if stored.State != data.SessionFinished {
+				t.Fatalf("stored state = %s, want %s", stored.State, data.SessionFinished)
+			}
+
+			want := map[bson.ObjectID]string{
+				students[0]: data.StatusPresent,
+				students[1]: data.StatusAbsent,
+			}
+			records := []data.Attendance{}
+			cur, err := recordsCollection(db).Find(ctx, bson.M{"sessionid": session.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cur.All(ctx, &records); err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(want) {
+				t.Fatalf("%d records, want %d", len(records), len(want))
+			}
+			for _, v := range records {
+				if v.Status != want[v.StudentID] {
+					t.Errorf("student %s status = %s, want %s", v.StudentID.Hex(), v.Status, want[v.StudentID])
+				}
+			}
+
+			// DONE sent again must not write anything
+			if _, err := finalizeSession(db, nil, session); !errors.Is(err, ErrSessionFinalized) {
+				t.Fatalf("second finalizeSession() err = %v, want %v", err, ErrSessionFinalized)
+			}
+		})
+	}
+}
+
+func TestSessionRegistryStartCopiesRules(t *testing.T) {
+	rules := SessionRules{
+		CustomStatuses: []data.StatusRule{{Name: "field trip", CountsAs: data.CountsAsPresent}},
+		Location:       &data.ClassLocation{Latitude: 1, Longitude: 2, RadiusMeters: 50},
+		RollCallPolicy: &data.RollCallPolicy{},
+	}
+
+	r := NewSessionRegistry()
+	classId := bson.NewObjectID()
+	if _, err := r.Start(classId, bson.NewObjectID(), nil, data.SessionSettings{}, rules); err != nil {
+		t.Fatal(err)
+	}
+
+	// whoever finds the session in the registry sees the rules already
+	session, _ := r.Get(classId.Hex())
+	if len(session.CustomStatuses) != 1 || session.Location != rules.Location || session.RollCallPolicy != rules.RollCallPolicy {
+		t.Fatalf("registered session rules = %v %v %v, want %v", session.CustomStatuses, session.Location, session.RollCallPolicy, rules)
+	}
+}
+
+func TestSessionRegistryStart(t *testing.T) {
+	r := NewSessionRegistry()
+	classId := bson.NewObjectID()
+	if _, err := r.Start(classId, bson.NewObjectID(), nil, data.SessionSettings{}, SessionRules{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		classId bson.ObjectID
+		err     error
+	}{
+		{"class with a running session", classId, ErrSessionOpen},
+		{"another class", bson.NewObjectID(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := r.Start(tt.classId, bson.NewObjectID(), nil, data.SessionSettings{}, SessionRules{}); !errors.Is(err, tt.err) {
+				t.Fatalf("Start() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSessionRegistryLookups(t *testing.T) {
+	teacher, other := bson.NewObjectID(), bson.NewObjectID()
+	student, both := bson.NewObjectID(), bson.NewObjectID()
+
+	r := NewSessionRegistry()
+	first, _ := r.Start(bson.NewObjectID(), teacher, []bson.ObjectID{student, both}, data.SessionSettings{}, SessionRules{})
+	second, _ := r.Start(bson.NewObjectID(), teacher, []bson.ObjectID{both}, data.SessionSettings{}, SessionRules{})
+	third, _ := r.Start(bson.NewObjectID(), other, []bson.ObjectID{both}, data.SessionSettings{}, SessionRules{})
+
+	tests := []struct {
+		name string
+		got  []*data.Session
+		want []*data.Session
+	}{
+		{"teacher with two classes", r.ForTeacher(teacher.Hex()), []*data.Session{first, second}},
+		{"teacher with one class", r.ForTeacher(other.Hex()), []*data.Session{third}},
+		{"teacher without a session", r.ForTeacher(student.Hex()), nil},
+		{"student in one class", r.ForStudent(student.Hex()), []*data.Session{first}},
+		{"student in every class", r.ForStudent(both.Hex()), []*data.Session{first, second, third}},
+		{"student in no class", r.ForStudent(teacher.Hex()), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.got) != len(tt.want) {
+				t.Fatalf("%d sessions, want %d", len(tt.got), len(tt.want))
+			}
+			for _, want := range tt.want {
+				if !slices.Contains(tt.got, want) {
+					t.Fatalf("session of class %s missing", want.ClassID.Hex())
+				}
+			}
+		})
+	}
+}
+
+func TestClientActiveSession(t *testing.T) {
+	teacher, student := bson.NewObjectID().Hex(), bson.NewObjectID()
+	teacherId, _ := bson.ObjectIDFromHex(teacher)
+
+	first, err := ActiveSessions.Start(bson.NewObjectID(), teacherId, []bson.ObjectID{student}, data.SessionSettings{}, SessionRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ActiveSessions.Start(bson.NewObjectID(), teacherId, nil, data.SessionSettings{}, SessionRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ActiveSessions.Remove(first)
+		ActiveSessions.Remove(second)
+	})
+
+	tests := []struct {
+		name    string
+		id      string
+		role    string
+		classId string
+		want    *data.Session
+		msg     string
+	}{
+		{"teacher naming the class", teacher, "teacher", second.ClassID.Hex(), second, ""},
+		{"teacher with two sessions", teacher, "teacher", "", nil, "Several attendance sessions running, name the classId"},
+		{"student with one session", student.Hex(), "student", "", first, ""},
+		{"student naming another class", student.Hex(), "student", second.ClassID.Hex(), nil, "Forbidden, not in class"},
+		{"other teacher", bson.NewObjectID().Hex(), "teacher", first.ClassID.Hex(), nil, "Forbidden, not in class"},
+		{"admin naming the class", bson.NewObjectID().Hex(), "admin", first.ClassID.Hex(), first, ""},
+		{"class without a session", teacher, "teacher", bson.NewObjectID().Hex(), nil, "No active attendance session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{id: tt.id, role: tt.role, hub: &Hub{join: make(chan *RoomJoin, 1)}}
+			session, msg := c.activeSession(WsReq{ClassID: tt.classId})
+			if session != tt.want || msg != tt.msg {
+				t.Fatalf("activeSession() = %v, %q, want %v, %q", session, msg, tt.want, tt.msg)
+			}
+			if tt.want != nil && c.classId != tt.want.ClassID.Hex() {
+				t.Fatalf("socket joined %q, want %s", c.classId, tt.want.ClassID.Hex())
+			}
+		})
+	}
+}
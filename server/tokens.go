@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"github.com/dinesht04/ws-attendance/util"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	AccessTokenLifetime  = 15 * time.Minute
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrTokenRevoked        = errors.New("token revoked")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused means a refresh token was presented after it was
+	// spent, so it leaked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+func refreshTokensCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("refresh_tokens")
+}
+
+func revokedTokensCollection(db *mongo.Client) *mongo.Collection {
+	return db.Database("attendance").Collection("revoked_tokens")
+}
+
+// EnsureTokenIndexes lets MongoDB drop refresh tokens, email tokens and
+// revocations once they expire, and makes lookups by hash unique.
+func EnsureTokenIndexes(db *mongo.Client) error {
+	ttl := mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	byHash := mongo.IndexModel{
+		Keys:    bson.M{"hash": 1},
+		Options: options.Index().SetUnique(true),
+	}
+	for _, collection := range []*mongo.Collection{refreshTokensCollection(db), emailTokensCollection(db)} {
+		if _, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{ttl, byHash}); err != nil {
+			return err
+		}
+	}
+	_, err := revokedTokensCollection(db).Indexes().CreateOne(context.Background(), ttl)
+	return err
+}
+
+// newOpaqueToken makes a random token for refresh and email tokens, which
+// are looked up by hash rather than verified by signature.
+func newOpaqueToken() string {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens signs an access token and stores a new refresh token for the
+// user. An empty family starts a new login.
+func issueTokens(ctx context.Context, db *mongo.Client, user data.User, family string) (string, string, error) {
+	if family == "" {
+		family = bson.NewObjectID().Hex()
+	}
+	now := time.Now().UTC()
+
+	access, err := signingKeys.Sign(MyClaims{
+		UserId:    user.ID.Hex(),
+		Role:      user.Role,
+		SessionID: family,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        bson.NewObjectID().Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenLifetime)),
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	refresh := newOpaqueToken()
+
+	_, err = refreshTokensCollection(db).InsertOne(ctx, data.RefreshToken{
+		ID:        bson.NewObjectID(),
+		UserID:    user.ID,
+		Hash:      hashToken(refresh),
+		Family:    family,
+		ExpiresAt: now.Add(RefreshTokenLifetime),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+func tokenResponse(c *gin.Context, access string, refresh string) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"token":        access,
+			"refreshToken": refresh,
+			"expiresIn":    int(AccessTokenLifetime / time.Second),
+		},
+	})
+}
+
+// verifyAccessToken checks the signature and expiry of an access token and
+// that neither it nor its login was revoked.
+func verifyAccessToken(ctx context.Context, db *mongo.Client, raw string) (*MyClaims, error) {
+	claims := &MyClaims{}
+	_, err := signingKeys.ParseWithClaims(raw, claims, jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.UserId == "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	count, err := revokedTokensCollection(db).CountDocuments(ctx, bson.M{"_id": bson.M{"$in": []string{claims.ID, claims.SessionID}}})
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// revokeAccessTokens blocks access tokens by jti or login family and closes
+// the sockets opened with them.
+func revokeAccessTokens(ctx context.Context, db *mongo.Client, hub *Hub, ids ...string) error {
+	expiresAt := time.Now().UTC().Add(AccessTokenLifetime)
+	for _, id := range ids {
+		_, err := revokedTokensCollection(db).ReplaceOne(ctx, bson.M{"_id": id}, data.RevokedToken{ID: id, ExpiresAt: expiresAt}, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	hub.revoke <- ids
+	return nil
+}
+
+// revokeUserLogins ends every login of the user, for when their role or
+// account state changes.
+func revokeUserLogins(ctx context.Context, db *mongo.Client, hub *Hub, userId bson.ObjectID) error {
+	filter := bson.M{
+		"user_id":    userId,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	families := []string{}
+	if err := refreshTokensCollection(db).Distinct(ctx, "family", filter).Decode(&families); err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		if err := revokeLogin(ctx, db, hub, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeLogin ends a login: its refresh tokens stop working and its access
+// tokens are blocked.
+func revokeLogin(ctx context.Context, db *mongo.Client, hub *Hub, family string) error {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"family":     family,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	_, err := refreshTokensCollection(db).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": now}})
+	if err != nil {
+		return err
+	}
+	return revokeAccessTokens(ctx, db, hub, family)
+}
+
+// checkRefreshToken decides whether a stored refresh token can be spent.
+func checkRefreshToken(token *data.RefreshToken, now time.Time) error {
+	if token.RevokedAt != nil {
+		return ErrRefreshTokenReused
+	}
+	if now.After(token.ExpiresAt) {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// rotateRefreshToken spends a refresh token. Presenting one that was already
+// spent means it leaked, so the whole login is revoked.
+func rotateRefreshToken(ctx context.Context, db *mongo.Client, hub *Hub, raw string) (*data.RefreshToken, error) {
+	token := &data.RefreshToken{}
+	err := refreshTokensCollection(db).FindOne(ctx, bson.M{"hash": hashToken(raw)}).Decode(token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := checkRefreshToken(token, time.Now()); errors.Is(err, ErrRefreshTokenReused) {
+		if err := revokeLogin(ctx, db, hub, token.Family); err != nil {
+			util.PrintError(err, "revoking login err")
+		}
+		return nil, ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	guard := bson.M{
+		"_id":        token.ID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	res, err := refreshTokensCollection(db).UpdateOne(ctx, guard, bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		// spent by a concurrent request
+		return nil, ErrInvalidRefreshToken
+	}
+	return token, nil
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// HandleRefresh trades a refresh token for a new access token and a new
+// refresh token.
+func HandleRefresh(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reqBody := RefreshRequest{}
+		if err := c.ShouldBind(&reqBody); err != nil {
+			c.JSON(400, gin.H{
+				"success": false,
+				"error":   "Invalid request schema",
+			})
+			util.PrintError(err, "Validaton and Binding err")
+			c.Abort()
+			return
+		}
+
+		token, err := rotateRefreshToken(c, db, hub, reqBody.RefreshToken)
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			util.AuthError(c, err, "refresh token err")
+			return
+		} else if err != nil {
+			util.InternalServerError(c, err, "refresh token rotation err")
+			return
+		}
+
+		// the role is read again, so a changed role applies from the next refresh
+		User := data.User{}
+		err = db.Database("attendance").Collection("users").FindOne(c, bson.M{"_id": token.UserID}).Decode(&User)
+		if err != nil {
+			util.AuthError(c, err, "Searching for user err")
+			return
+		}
+		if User.Deactivated {
+			util.AuthError(c, fmt.Errorf("user %s deactivated", User.ID.Hex()))
+			return
+		}
+
+		access, refresh, err := issueTokens(c, db, User, token.Family)
+		if err != nil {
+			util.InternalServerError(c, err, "issuing tokens err")
+			return
+		}
+
+		tokenResponse(c, access, refresh)
+	}
+}
+
+// HandleLogout ends the login the access token belongs to and closes its
+// sockets.
+func HandleLogout(db *mongo.Client, hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := revokeLogin(c, db, hub, c.GetString("sid")); err != nil {
+			util.InternalServerError(c, err, "revoking login err")
+			return
+		}
+		if err := revokeAccessTokens(c, db, hub, c.GetString("jti")); err != nil {
+			util.InternalServerError(c, err, "revoking token err")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    nil,
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dinesht04/ws-attendance/data"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestCheckRefreshToken(t *testing.T) {
+	now := time.Now()
+	spent := now.Add(-time.Minute)
+
+	tests := []struct {
+		name  string
+		token data.RefreshToken
+		err   error
+	}{
+		{"fresh", data.RefreshToken{ExpiresAt: now.Add(time.Hour)}, nil},
+		{"expired", data.RefreshToken{ExpiresAt: now.Add(-time.Second)}, ErrInvalidRefreshToken},
+		{"spent", data.RefreshToken{ExpiresAt: now.Add(time.Hour), RevokedAt: &spent}, ErrRefreshTokenReused},
+		// reuse is reported even after expiry, so a leaked token still
+		// revokes its login
+		{"spent and expired", data.RefreshToken{ExpiresAt: now.Add(-time.Second), RevokedAt: &spent}, ErrRefreshTokenReused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRefreshToken(&tt.token, now); !errors.Is(err, tt.err) {
+				t.Fatalf("checkRefreshToken() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOpaqueTokens(t *testing.T) {
+	a, b := newOpaqueToken(), newOpaqueToken()
+	if a == b {
+		t.Fatal("newOpaqueToken() returned the same token twice")
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"same token", a, a, true},
+		{"different tokens", a, b, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hashToken(tt.a) == hashToken(tt.b); got != tt.same {
+				t.Fatalf("hashes equal = %v, want %v", got, tt.same)
+			}
+			if hashToken(tt.a) == tt.a {
+				t.Fatal("hashToken() returned the token itself")
+			}
+		})
+	}
+}
+
+// testLogin signs tokens with a test key and logs a new user in. The hub
+// only collects what would be revoked.
+func testLogin(t *testing.T, db *mongo.Client) (*Hub, data.User) {
+	t.Helper()
+	useTestKeys(t, "test secret")
+
+	user := data.User{ID: bson.NewObjectID(), Role: "student"}
+	t.Cleanup(func() {
+		refreshTokensCollection(db).DeleteMany(context.Background(), bson.M{"user_id": user.ID})
+	})
+	return &Hub{revoke: make(chan []string, 10)}, user
+}
+
+// login issues tokens for a new login of the user and returns the parsed
+// access token too.
+func login(t *testing.T, db *mongo.Client, user data.User) (*MyClaims, string) {
+	t.Helper()
+	access, refresh, err := issueTokens(context.Background(), db, user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := verifyAccessToken(context.Background(), db, access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		revokedTokensCollection(db).DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": []string{claims.ID, claims.SessionID}}})
+	})
+	return claims, refresh
+}
+
+// revokedIds drains what the hub was asked to close sockets for.
+func revokedIds(hub *Hub) map[string]bool {
+	ids := map[string]bool{}
+	for {
+		select {
+		case v := <-hub.revoke:
+			for _, id := range v {
+				ids[id] = true
+			}
+		default:
+			return ids
+		}
+	}
+}
+
+func TestRotateRefreshTokenReuse(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	hub, user := testLogin(t, db)
+
+	claims, first := login(t, db, user)
+	if _, err := rotateRefreshToken(ctx, db, hub, first); err != nil {
+		t.Fatalf("first rotation err = %v", err)
+	}
+	access, second, err := issueTokens(ctx, db, user, claims.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherRefresh := login(t, db, user)
+
+	// the spent token comes back, so it leaked
+	if _, err := rotateRefreshToken(ctx, db, hub, first); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("reused token err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+
+	if _, err := rotateRefreshToken(ctx, db, hub, second); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("latest token of the login err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	if _, err := verifyAccessToken(ctx, db, access); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("access token of the login err = %v, want %v", err, ErrTokenRevoked)
+	}
+	if ids := revokedIds(hub); !ids[claims.SessionID] {
+		t.Fatalf("sockets closed for %v, want login %s", ids, claims.SessionID)
+	}
+
+	// the user's other login is left alone
+	if _, err := rotateRefreshToken(ctx, db, hub, otherRefresh); err != nil {
+		t.Fatalf("other login's refresh err = %v", err)
+	}
+	if ids := revokedIds(hub); ids[other.SessionID] {
+		t.Fatal("other login's sockets closed")
+	}
+}
+
+func TestVerifyAccessTokenRevoked(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	hub, user := testLogin(t, db)
+
+	tests := []struct {
+		name   string
+		revoke func(claims *MyClaims) []string
+		err    error
+	}{
+		{"not revoked", func(claims *MyClaims) []string { return nil }, nil},
+		{"token revoked", func(claims *MyClaims) []string { return []string{claims.ID} }, ErrTokenRevoked},
+		{"login revoked", func(claims *MyClaims) []string { return []string{claims.SessionID} }, ErrTokenRevoked},
+		{"other login revoked", func(claims *MyClaims) []string { return []string{bson.NewObjectID().Hex()} }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, _, err := issueTokens(ctx, db, user, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := &MyClaims{}
+			if _, err := signingKeys.ParseWithClaims(access, claims); err != nil {
+				t.Fatal(err)
+			}
+
+			if ids := tt.revoke(claims); len(ids) > 0 {
+				if err := revokeAccessTokens(ctx, db, hub, ids...); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { revokedTokensCollection(db).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}) })
+			}
+
+			if _, err := verifyAccessToken(ctx, db, access); !errors.Is(err, tt.err) {
+				t.Fatalf("verifyAccessToken() err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	db := testMongo(t)
+	ctx := context.Background()
+	hub, user := testLogin(t, db)
+
+	claims, refresh := login(t, db, user)
+	_, otherRefresh := login(t, db, user)
+
+	code, reply := runHandler(t, HandleLogout(db, hub), testRequest{
+		method: http.MethodPost,
+		values: map[string]any{"userId": user.ID.Hex(), "sid": claims.SessionID, "jti": claims.ID},
+	})
+	if code != 200 {
+		t.Fatalf("status = %d, reply %v", code, reply)
+	}
+
+	if _, err := rotateRefreshToken(ctx, db, hub, refresh); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("refresh after logout err = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	if ids := revokedIds(hub); !ids[claims.ID] || !ids[claims.SessionID] {
+		t.Fatalf("sockets closed for %v, want token %s and login %s", ids, claims.ID, claims.SessionID)
+	}
+	if _, err := rotateRefreshToken(ctx, db, hub, otherRefresh); err != nil {
+		t.Fatalf("other login's refresh err = %v", err)
+	}
+}
@@ -3,7 +3,7 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/dinesht04/ws-attendance/data"
@@ -22,8 +22,12 @@ type Data struct {
 }
 
 type WsReq struct {
-	Event string      `json:"event"`
-	Data  interface{} `json:"data"`
+	Event     string `json:"event"`
+	RequestID string `json:"requestId,omitempty"`
+	// ClassID names the class whose session the event acts on. It defaults
+	// to the room the socket joined.
+	ClassID string      `json:"classId,omitempty"`
+	Data    interface{} `json:"data"`
 }
 
 type AttendanceData struct {
@@ -37,9 +41,10 @@ type WsAttendanceMarkReq struct {
 }
 
 type WsTodaySummaryData struct {
-	Present int `json:"present"`
-	Absent  int `json:"absent"`
-	Total   int `json:"total"`
+	Present  int            `json:"present"`
+	Absent   int            `json:"absent"`
+	Total    int            `json:"total"`
+	ByStatus map[string]int `json:"byStatus"`
 }
 
 type WsTodaySummary struct {
@@ -57,10 +62,11 @@ type WsMyAttendance struct {
 }
 
 type WsDoneData struct {
-	Message string `json:"message"`
-	Present int    `json:"present"`
-	Absent  int    `json:"absent"`
-	Total   int    `json:"total"`
+	Message  string         `json:"message"`
+	Present  int            `json:"present"`
+	Absent   int            `json:"absent"`
+	Total    int            `json:"total"`
+	ByStatus map[string]int `json:"byStatus"`
 }
 
 type WsDone struct {
@@ -68,13 +74,99 @@ type WsDone struct {
 	Data  WsDoneData `json:"data"`
 }
 
+type WsSessionData struct {
+	ClassID   string `json:"classId"`
+	StartedAt string `json:"startedAt"`
+	Paused    bool   `json:"paused"`
+}
+
+type WsSession struct {
+	Event string        `json:"event"`
+	Data  WsSessionData `json:"data"`
+}
+
+type WsJoinData struct {
+	ClassID string `json:"classId"`
+}
+
+type WsJoin struct {
+	Event string     `json:"event"`
+	Data  WsJoinData `json:"data"`
+}
+
+type WsCheckInData struct {
+	Code     string            `json:"code"`
+	Location *data.Coordinates `json:"location"`
+	DeviceID string            `json:"deviceId"`
+}
+
+type WsCheckIn struct {
+	Event string        `json:"event"`
+	Data  WsCheckInData `json:"data"`
+}
+
+type WsResumeData struct {
+	ClassID string `json:"classId"`
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+type WsResume struct {
+	Event string       `json:"event"`
+	Data  WsResumeData `json:"data"`
+}
+
+type WsResumedData struct {
+	ClassID  string `json:"classId"`
+	Seq      uint64 `json:"seq"`
+	Replayed int    `json:"replayed"`
+	Complete bool   `json:"complete"`
+}
+
+type WsResumed struct {
+	Event string        `json:"event"`
+	Data  WsResumedData `json:"data"`
+}
+
 type WsErrorData struct {
 	Message string `json:"message"`
 }
 
 type wsError struct {
-	Event string      `json:"event"`
-	Data  WsErrorData `json:"data"`
+	Event     string      `json:"event"`
+	RequestID string      `json:"requestId,omitempty"`
+	Data      WsErrorData `json:"data"`
+}
+
+type WsAckData struct {
+	Event string `json:"event"`
+}
+
+type WsAck struct {
+	Event     string    `json:"event"`
+	RequestID string    `json:"requestId"`
+	Data      WsAckData `json:"data"`
+}
+
+// SequencedEvent is a broadcast stamped with the room's sequence number, so
+// clients can spot events they missed.
+type SequencedEvent struct {
+	Seq   uint64
+	Event WsEvent
+}
+
+func (s SequencedEvent) MarshalJSON() ([]byte, error) {
+	raw, err := json.Marshal(s.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	fields["seq"], _ = json.Marshal(s.Seq)
+
+	return json.Marshal(fields)
 }
 
 type WsEvent interface {
@@ -85,8 +177,14 @@ func (w WsAttendanceMarkReq) EventName() string { return w.Event }
 func (w WsTodaySummary) EventName() string      { return w.Event }
 func (w WsMyAttendance) EventName() string      { return w.Event }
 func (w WsDone) EventName() string              { return w.Event }
+func (w WsJoin) EventName() string              { return w.Event }
+func (w WsSession) EventName() string           { return w.Event }
 func (w wsError) EventName() string             { return w.Event }
 func (w WsReq) EventName() string               { return w.Event }
+func (w WsAck) EventName() string               { return w.Event }
+func (w WsResumed) EventName() string           { return w.Event }
+func (w WsBulkMarked) EventName() string        { return w.Event }
+func (w SequencedEvent) EventName() string      { return w.Event.EventName() }
 
 func handleWebsocket(db *mongo.Client, h *Hub) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
@@ -98,11 +196,16 @@ func handleWebsocket(db *mongo.Client, h *Hub) gin.HandlerFunc {
 		}
 
 		client := &Client{
-			id:   ctx.GetString("userId"),
-			hub:  h,
-			conn: c,
-			send: make(chan WsEvent, 256),
-			role: ctx.GetString("role"),
+			id:        ctx.GetString("userId"),
+			hub:       h,
+			conn:      c,
+			send:      make(chan WsEvent, 256),
+			role:      ctx.GetString("role"),
+			classId:   ctx.GetString("classId"),
+			ip:        ctx.ClientIP(),
+			userAgent: ctx.Request.UserAgent(),
+			jti:       ctx.GetString("jti"),
+			sid:       ctx.GetString("sid"),
 		}
 
 		client.hub.register <- client
@@ -122,165 +225,161 @@ func (c *Client) readPump(db *mongo.Client) {
 	for {
 		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
-			fmt.Println(err, "reading msg error")
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				util.PrintError(err, "reading msg error")
+			}
+			return
 		}
 
-		valid := json.Valid(msg)
-		fmt.Println(string(msg))
-		if !valid {
-			fmt.Println("json is valid: ", valid)
-			errMsg := wsError{
-				Event: "ERROR",
-				Data: WsErrorData{
-					Message: "Invalid JSON",
-				},
-			}
-			c.send <- errMsg
+		if !json.Valid(msg) {
+			c.sendError("", "Invalid JSON")
 			continue
 		}
 		req := WsReq{}
 
 		err = json.Unmarshal(msg, &req)
 		if err != nil {
-			errMsg := wsError{
-				Event: "ERROR",
-				Data: WsErrorData{
-					Message: "Invalid JSON",
-				},
-			}
-			c.send <- errMsg
-
+			c.sendError("", "Invalid JSON")
 			continue
 		}
 
 		//this is where we handle everything
 
 		switch req.Event {
-		case "ATTENDANCE_MARKED":
-			if c.role != "teacher" {
+		case "JOIN":
+			jsonData, _ := json.Marshal(req)
+			var join WsJoin
+			if err := json.Unmarshal(jsonData, &join); err != nil || join.Data.ClassID == "" {
+				c.sendError(req.RequestID, "Invalid format")
+				continue
+			}
 
-				errMsg := wsError{
-					Event: "ERROR",
-					Data: WsErrorData{
-						Message: "Forbidden, teacher event only",
-					},
-				}
+			class, _, msg := authorizeClass(context.Background(), db, join.Data.ClassID, c.id, c.role)
+			if class == nil {
+				c.sendError(req.RequestID, msg)
+				continue
+			}
 
-				c.send <- errMsg
-			} else if ActiveSession.StartedAt == "" {
+			c.joinRoom(class.ID.Hex())
+			c.send <- WsJoin{Event: "JOINED", Data: WsJoinData{ClassID: class.ID.Hex()}}
+			c.ack(req)
 
-				errMsg := &wsError{
-					Event: "ERROR",
-					Data: WsErrorData{
-						Message: "No active attendance session",
-					},
-				}
+		case "RESUME":
+			jsonData, _ := json.Marshal(req)
+			var resume WsResume
+			if err := json.Unmarshal(jsonData, &resume); err != nil || resume.Data.ClassID == "" {
+				c.sendError(req.RequestID, "Invalid format")
+				continue
+			}
 
-				c.send <- errMsg
+			class, _, msg := authorizeClass(context.Background(), db, resume.Data.ClassID, c.id, c.role)
+			if class == nil {
+				c.sendError(req.RequestID, msg)
+				continue
+			}
+
+			c.classId = class.ID.Hex()
+			c.hub.join <- &RoomJoin{client: c, classId: c.classId, resume: true, lastSeq: resume.Data.LastSeq}
+			c.ack(req)
+
+		case "ATTENDANCE_MARKED":
+			if session, msg := c.teacherSession(req); session == nil {
+				c.sendError(req.RequestID, msg)
 			} else {
 
 				jsonData, _ := json.Marshal(req)
 				var attendance WsAttendanceMarkReq
 				if err := json.Unmarshal(jsonData, &attendance); err != nil {
-					c.send <- wsError{Event: "ERROR", Data: WsErrorData{Message: "Invalid format"}}
+					c.sendError(req.RequestID, "Invalid format")
+					continue
 				}
 
-				ActiveSession.Lock()
-				ActiveSession.AttendanceStatus[attendance.Data.StudentID] = attendance.Data.Status
-				ActiveSession.Unlock()
+				// the id becomes part of a field path when saved, so only
+				// roster ids get through
+				studentId, err := bson.ObjectIDFromHex(attendance.Data.StudentID)
+				if err != nil || !onRoster(session, studentId.Hex()) {
+					c.sendError(req.RequestID, "Student not enrolled in class")
+					continue
+				}
+				attendance.Data.StudentID = studentId.Hex()
+
+				session.Lock()
+				if _, ok := data.FindStatusRule(session.CustomStatuses, attendance.Data.Status); !ok {
+					session.Unlock()
+					c.sendError(req.RequestID, "Invalid status")
+					continue
+				}
+				if session.Paused {
+					session.Unlock()
+					c.sendError(req.RequestID, "Attendance session is paused")
+					continue
+				}
+				mark := data.Mark{
+					Status:   attendance.Data.Status,
+					MarkedAt: time.Now().UTC(),
+					Method:   MarkedByTeacher,
+				}
+				if err := saveMark(db, session, attendance.Data.StudentID, mark); err != nil {
+					session.Unlock()
+					util.PrintError(err, "saving mark err")
+					c.sendError(req.RequestID, "Could not save attendance")
+					continue
+				}
+				session.AttendanceStatus[attendance.Data.StudentID] = mark
+				session.Unlock()
 
 				message := &Message{
 					Type:     "ATTENDANCE_MARKED",
 					ClientID: c.id,
+					ClassID:  session.ClassID.Hex(),
 					Text:     attendance,
 				}
 
 				c.hub.broadcast <- message
+				c.ack(req)
 			}
 
 		case "TODAY_SUMMARY":
-			if c.role != "teacher" {
-				errMsg := &wsError{
-					Event: "Auth eroor",
-					Data: WsErrorData{
-						Message: "Forbidden, teacher event only",
-					},
-				}
-
-				c.send <- errMsg
-			} else if ActiveSession.StartedAt == "" {
-
-				errMsg := &wsError{
-					Event: "Event error",
-					Data: WsErrorData{
-						Message: "No active attendance sessions",
-					},
-				}
-
-				c.send <- *errMsg
+			if session, msg := c.teacherSession(req); session == nil {
+				c.sendError(req.RequestID, msg)
 			} else {
-				absent := 0
-				present := 0
-				total := 0
-				for _, v := range ActiveSession.AttendanceStatus {
-					switch v {
-					case "present":
-						present++
-					case "absent":
-						absent++
-					default:
-						continue
-					}
-				}
-				total = present + absent
-
-				jsonData, _ := json.Marshal(req)
-				var today_summary WsTodaySummary
-				err := json.Unmarshal(jsonData, &today_summary)
-				if err != nil {
-					c.send <- wsError{Event: "ERROR", Data: WsErrorData{Message: "Invalid format"}}
-				}
+				session.Lock()
+				summary := summarizeSession(session)
+				session.Unlock()
 
 				wsMsg := Message{
 					ClientID: c.id,
+					ClassID:  session.ClassID.Hex(),
 					Text: WsTodaySummary{
 						Event: "TODAY_SUMMARY",
 						Data: WsTodaySummaryData{
-							Present: present,
-							Absent:  absent,
-							Total:   total,
+							Present:  summary.Present,
+							Absent:   summary.Absent,
+							Total:    summary.Total,
+							ByStatus: summary.ByStatus,
 						},
 					},
 				}
 				c.hub.broadcast <- &wsMsg
+				c.ack(req)
 			}
 
 		case "MY_ATTENDANCE":
 			if c.role != "student" {
-				errMsg := wsError{
-					Event: "ERROR",
-					Data: WsErrorData{
-						Message: "Forbidden, student event only",
-					},
-				}
-				c.send <- errMsg
-			} else if ActiveSession.StartedAt == "" {
-				errMsg := &wsError{
-					Event: "Event error",
-					Data: WsErrorData{
-						Message: "No active attendance sessions",
-					},
-				}
-				c.send <- *errMsg
+				c.sendError(req.RequestID, "Forbidden, student event only")
+			} else if session, msg := c.activeSession(req); session == nil {
+				c.sendError(req.RequestID, msg)
 			} else {
 
 				status := ""
 
-				if value, ok := ActiveSession.AttendanceStatus[c.id]; ok {
-					status = value
+				session.Lock()
+				if value, ok := session.AttendanceStatus[c.id]; ok {
+					status = value.Status
 				} else {
 					status = "not yet update"
 				}
+				session.Unlock()
 
 				wsMsg := WsMyAttendance{
 					Event: "MY_ATTENDANCE",
@@ -289,107 +388,143 @@ func (c *Client) readPump(db *mongo.Client) {
 					},
 				}
 				c.send <- wsMsg
+				c.ack(req)
 			}
-		case "DONE":
-			if c.role != "teacher" {
-				c.send <- wsError{Event: "ERROR", Data: WsErrorData{Message: "Forbidden, teacher event only"}}
-			} else if ActiveSession.StartedAt == "" {
-				c.send <- wsError{Event: "ERROR", Data: WsErrorData{Message: "No active attendance session"}}
-			} else {
+		case "BULK_MARK":
+			c.wsBulkMark(db, req)
 
-				present := 0
-				absent := 0
-				total := 0
+		case "ROLL_CALL":
+			c.wsRollCall(db, req)
 
-				collection := db.Database("attendance").Collection("class")
-				//get all students from class id
+		case "ROLL_CALL_ANSWER":
+			c.wsRollCallAnswer(req)
 
-				filter := bson.M{
-					"_id": ActiveSession.ClassID,
-				}
-				var class data.Class
-				err := collection.FindOne(context.Background(), filter).Decode(&class)
-				if err != nil {
-					panic(err)
-				}
+		case "PRESENCE":
+			c.wsPresence(req)
 
-				//mark the students who havent joined absent
-				//iterate through the studentids array, if it doesnt exist in the hashmap then add and status = absent
+		case "CHECK_IN":
+			c.wsCheckIn(db, req)
 
-				for _, v := range class.StudentIDs {
-					if _, ok := ActiveSession.AttendanceStatus[v.Hex()]; ok {
-						continue
-					} else {
-						ActiveSession.AttendanceStatus[v.Hex()] = "absent"
-					}
+		case "DONE":
+			if session, msg := c.teacherSession(req); session == nil {
+				c.sendError(req.RequestID, msg)
+			} else {
+				done, err := finalizeSession(db, c.hub, session)
+				if errors.Is(err, ErrSessionFinalized) {
+					c.sendError(req.RequestID, "Attendance already persisted")
+					continue
+				} else if err != nil {
+					util.PrintError(err, "finalizing session err")
+					c.sendError(req.RequestID, "Could not persist attendance")
+					continue
 				}
 
-				//iterate through the hashmap and for each record add an entry into attendance collection
-
-				for k, v := range ActiveSession.AttendanceStatus {
-
-					studentId, _ := bson.ObjectIDFromHex(k)
-
-					Record := &data.Attendance{
-						ID:        bson.NewObjectID(),
-						ClassID:   ActiveSession.ClassID,
-						StudentID: studentId,
-						Status:    v,
-					}
-
-					_, err := db.Database("attendance").Collection("records").InsertOne(context.Background(), &Record)
-					if err != nil {
-						panic(err)
-					}
-
-				}
+				broadcastDone(c.hub, c.id, session, done)
+				c.ack(req)
+			}
 
-				//final summary and send
+		default:
+			c.sendError(req.RequestID, "Unknown event")
+		}
 
-				for _, v := range ActiveSession.AttendanceStatus {
-					switch v {
-					case "present":
-						present++
-					case "absent":
-						absent++
-					}
-				}
-				total = present + absent
+	}
 
-				//persist class data to db
+}
 
-				done := WsDone{
-					Event: "EVENT",
-					Data: WsDoneData{
-						Message: "Attendance Persisted",
-						Present: present,
-						Absent:  absent,
-						Total:   total,
-					},
-				}
+// sendError replies with an ERROR event, echoing the request id when the
+// client sent one.
+func (c *Client) sendError(requestId string, message string) {
+	c.send <- wsError{
+		Event:     "ERROR",
+		RequestID: requestId,
+		Data: WsErrorData{
+			Message: message,
+		},
+	}
+}
 
-				Message := &Message{
-					ClientID: c.id,
-					Type:     "DONE",
-					Text:     done,
-				}
+// ack confirms a handled request. Clients that do not send a request id get
+// no ACK.
+func (c *Client) ack(req WsReq) {
+	if req.RequestID == "" {
+		return
+	}
+	c.send <- WsAck{
+		Event:     "ACK",
+		RequestID: req.RequestID,
+		Data: WsAckData{
+			Event: req.Event,
+		},
+	}
+}
 
-				c.hub.broadcast <- Message
-			}
+// activeSession resolves the attendance session an event acts on: that of
+// the class the event names, or else of the room the client joined. A client
+// in no room that names no class gets its only running session and is placed
+// in that room, so it still receives the session's broadcasts. With several
+// running the event must name the class. On failure it returns the error
+// message to send back.
+func (c *Client) activeSession(req WsReq) (*data.Session, string) {
+	classId := req.ClassID
+	if classId == "" {
+		classId = c.classId
+	}
+	if classId != "" {
+		session, ok := ActiveSessions.Get(classId)
+		if !ok {
+			return nil, "No active attendance session"
+		}
+		if !c.inSession(session) {
+			return nil, "Forbidden, not in class"
+		}
+		if c.classId == "" {
+			c.joinRoom(classId)
+		}
+		return session, ""
+	}
 
-		default:
-			errMsg := wsError{
-				Event: "Event error",
-				Data: WsErrorData{
-					Message: "invaid format",
-				},
-			}
+	var sessions []*data.Session
+	if c.role == "student" {
+		sessions = ActiveSessions.ForStudent(c.id)
+	} else {
+		sessions = ActiveSessions.ForTeacher(c.id)
+	}
+	switch len(sessions) {
+	case 0:
+		return nil, "No active attendance session"
+	case 1:
+		c.joinRoom(sessions[0].ClassID.Hex())
+		return sessions[0], ""
+	default:
+		return nil, "Several attendance sessions running, name the classId"
+	}
+}
 
-			c.send <- errMsg
-		}
+// inSession reports whether the client runs the session's class or is on its
+// roster.
+func (c *Client) inSession(session *data.Session) bool {
+	if c.role == "student" {
+		return onRoster(session, c.id)
+	}
+	return managesClass(c.id, c.role, session.TeacherID)
+}
 
+// teacherSession resolves the session of a teacher event, refusing clients
+// that do not run its class.
+func (c *Client) teacherSession(req WsReq) (*data.Session, string) {
+	session, msg := c.activeSession(req)
+	if session == nil {
+		return nil, msg
+	}
+	if !managesClass(c.id, c.role, session.TeacherID) {
+		return nil, "Forbidden, teacher event only"
 	}
+	return session, ""
+}
 
+func (c *Client) joinRoom(classId string) {
+	c.classId = classId
+	c.hub.join <- &RoomJoin{client: c, classId: classId}
 }
 
 func (c *Client) writePump() {
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestRequestCorrelation(t *testing.T) {
+	student := bson.NewObjectID().Hex()
+	rollCall := &RollCall{
+		ID:       bson.NewObjectID().Hex(),
+		Deadline: time.Now().Add(time.Minute),
+		students: map[string]bool{student: false},
+	}
+	ActiveRollCalls.Add(rollCall)
+	t.Cleanup(func() { ActiveRollCalls.Close(rollCall.ID) })
+
+	answer := func(requestId string, rollCallId string) WsReq {
+		return WsReq{
+			Event:     "ROLL_CALL_ANSWER",
+			RequestID: requestId,
+			Data:      map[string]any{"rollCallId": rollCallId},
+		}
+	}
+
+	tests := []struct {
+		name string
+		role string
+		req  WsReq
+		// the event sent back, or "" when nothing is
+		want string
+	}{
+		{"handled with a request id", "student", answer("r1", rollCall.ID), "ACK"},
+		{"handled without a request id", "student", answer("", rollCall.ID), ""},
+		{"refused with a request id", "teacher", answer("r2", rollCall.ID), "ERROR"},
+		{"refused without a request id", "student", answer("", bson.NewObjectID().Hex()), "ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{id: student, role: tt.role, send: make(chan WsEvent, 1)}
+			c.wsRollCallAnswer(tt.req)
+
+			if tt.want == "" {
+				if len(c.send) != 0 {
+					t.Fatalf("sent %v, want nothing", <-c.send)
+				}
+				return
+			}
+			if len(c.send) == 0 {
+				t.Fatalf("nothing sent, want %s", tt.want)
+			}
+
+			var event, requestId string
+			switch reply := (<-c.send).(type) {
+			case WsAck:
+				event, requestId = reply.Event, reply.RequestID
+				if reply.Data.Event != tt.req.Event {
+					t.Errorf("ACK names event %q, want %q", reply.Data.Event, tt.req.Event)
+				}
+			case wsError:
+				event, requestId = reply.Event, reply.RequestID
+			default:
+				t.Fatalf("sent %T", reply)
+			}
+			if event != tt.want || requestId != tt.req.RequestID {
+				t.Fatalf("sent %s for %q, want %s for %q", event, requestId, tt.want, tt.req.RequestID)
+			}
+		})
+	}
+}